@@ -0,0 +1,115 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// The lowest SPI speed which can keep up with the camera's
+	// output (as per the Lepton datasheet).
+	minSPISpeed = 2200000
+
+	// Each adjustment changes the SPI speed by this factor.
+	speedStepDown = 0.75
+)
+
+// AdaptiveSpeed configures automatic adjustment of the SPI clock speed
+// in response to errors. Marginal wiring often works reliably at a
+// lower clock speed, so when the error rate is high the speed is
+// stepped down. The SPI connection has to be reopened to change its
+// speed, so the next resync after a change reopens it whatever the
+// resync policy (see SetResyncPolicy).
+type AdaptiveSpeed struct {
+	// MinSpeed is the lowest speed (in Hz) that will be stepped down
+	// to. It can't be lower than the minimum the camera supports.
+	MinSpeed int64
+
+	// Window is the number of frames over which the error rate is
+	// measured before deciding whether to adjust the speed.
+	Window int
+
+	// MaxErrorRate is the number of resyncs per frame, averaged over
+	// a window, above which the speed is stepped down.
+	MaxErrorRate float64
+
+	// StepUp enables stepping the speed back up after a window
+	// without any resyncs. The speed never exceeds the speed given
+	// when the Lepton3 was created.
+	StepUp bool
+}
+
+// SetAdaptiveSpeed enables adaptive SPI speed adjustment using the
+// configuration given. Passing nil disables it and restores the speed
+// given when the Lepton3 was created (from the next Open). Adaptive
+// speed is disabled by default.
+func (d *Lepton3) SetAdaptiveSpeed(cfg *AdaptiveSpeed) error {
+	if cfg == nil {
+		d.adaptive = nil
+		d.nextSpeed = d.spiSpeed
+		return nil
+	}
+	if cfg.MinSpeed < minSPISpeed || cfg.MinSpeed > d.spiSpeed {
+		return fmt.Errorf("minimum speed must be between %d and %d Hz", minSPISpeed, d.spiSpeed)
+	}
+	if cfg.Window < 1 {
+		return errors.New("window must be at least 1 frame")
+	}
+	if cfg.MaxErrorRate < 0 {
+		return errors.New("maximum error rate can't be negative")
+	}
+	c := *cfg
+	d.adaptive = &c
+	d.windowFrames = 0
+	d.windowResyncs = 0
+	return nil
+}
+
+// SPISpeed returns the SPI clock speed (in Hz) of the current
+// connection to the camera. If the camera isn't open, the speed which
+// will be used by the next Open is returned.
+func (d *Lepton3) SPISpeed() int64 {
+	if d.IsOpen() {
+		return d.openSpeed
+	}
+	return d.nextSpeed
+}
+
+// adaptSpeed records the number of resyncs needed to read a frame
+// and, at the end of each window, adjusts the speed used by the next
+// Open if required.
+func (d *Lepton3) adaptSpeed(resyncs int) {
+	a := d.adaptive
+	if a == nil {
+		return
+	}
+	d.windowFrames++
+	d.windowResyncs += resyncs
+	if d.windowFrames < a.Window {
+		return
+	}
+	rate := float64(d.windowResyncs) / float64(d.windowFrames)
+	d.windowFrames = 0
+	d.windowResyncs = 0
+
+	speed := d.nextSpeed
+	if rate > a.MaxErrorRate {
+		speed = int64(float64(speed) * speedStepDown)
+		if speed < a.MinSpeed {
+			speed = a.MinSpeed
+		}
+	} else if rate == 0 && a.StepUp {
+		speed = int64(float64(speed) / speedStepDown)
+		if speed > d.spiSpeed {
+			speed = d.spiSpeed
+		}
+	}
+	if speed != d.nextSpeed {
+		d.logf(LogInfo, "changing SPI speed from %d to %d Hz (%.2f resyncs/frame)", d.nextSpeed, speed, rate)
+		d.nextSpeed = speed
+	}
+}
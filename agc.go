@@ -0,0 +1,279 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+)
+
+// AGC (automatic gain control) converts 16-bit frames to 8-bit
+// images suitable for display. Custom tone mapping can be supplied by
+// implementing this interface.
+type AGC interface {
+	// Apply writes the 8-bit version of src into dst, which has the
+	// same bounds as src.
+	Apply(src *image.Gray16, dst *image.Gray)
+}
+
+var (
+	_ AGC = MinMaxAGC{}
+	_ AGC = (*PercentileAGC)(nil)
+	_ AGC = (*HistEqAGC)(nil)
+)
+
+// ToGray converts src to an 8-bit image using agc. If agc is nil
+// MinMaxAGC is used.
+func ToGray(src *image.Gray16, agc AGC) *image.Gray {
+	if agc == nil {
+		agc = MinMaxAGC{}
+	}
+	dst := image.NewGray(src.Bounds())
+	agc.Apply(src, dst)
+	return dst
+}
+
+// Polarity selects whether hot objects are displayed as light
+// (white-hot) or dark (black-hot).
+type Polarity int
+
+// Valid values for Polarity.
+const (
+	WhiteHot Polarity = iota
+	BlackHot
+)
+
+// WithPolarity returns an AGC which applies agc and then maps the
+// output to the requested polarity. WhiteHot returns agc unchanged
+// (this matches the raw output where higher values are hotter).
+// Colorize, ColorizeInto and ColorizeFramebuffer map the 8-bit output
+// of an AGC to colours, so palettes follow the polarity too: with
+// BlackHot the hottest pixels use the first palette entry.
+func WithPolarity(agc AGC, p Polarity) AGC {
+	if p == WhiteHot {
+		return agc
+	}
+	return blackHotAGC{agc}
+}
+
+type blackHotAGC struct {
+	AGC
+}
+
+func (a blackHotAGC) Apply(src *image.Gray16, dst *image.Gray) {
+	a.AGC.Apply(src, dst)
+	b := dst.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := dst.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Pix[i] = 255 - dst.Pix[i]
+			i++
+		}
+	}
+}
+
+// InvertGray16 inverts the pixel values of img in place, converting
+// white-hot 16-bit output to black-hot.
+func InvertGray16(img *image.Gray16) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.Pix[i] = 255 - img.Pix[i]
+			img.Pix[i+1] = 255 - img.Pix[i+1]
+			i += 2
+		}
+	}
+}
+
+// MinMaxAGC linearly stretches the range between the coldest and
+// hottest pixels to the full 8-bit output range. Pixels excluded by
+// Mask are ignored when finding the range.
+//
+// If Stats is set its range is used instead of finding the range
+// again. This saves a pass over the pixels when the statistics are
+// already known, such as FrameInfo.Stats (see SetStatsMask) or the
+// result of ComputePixelStats with the same mask. Stats must be
+// updated for each frame.
+type MinMaxAGC struct {
+	Mask  *Mask
+	Stats *PixelStats
+}
+
+// Apply writes the contrast adjusted version of src to dst, which
+// must have the same bounds.
+func (a MinMaxAGC) Apply(src *image.Gray16, dst *image.Gray) {
+	var stats PixelStats
+	if a.Stats != nil {
+		stats = *a.Stats
+	} else {
+		stats = ComputePixelStats(src, a.Mask)
+	}
+	stretch(src, dst, stats.Min, stats.Max)
+}
+
+// PercentileAGC is like MinMaxAGC except that the range stretched is
+// between the Low and High percentiles (0-100) of the pixel values
+// instead of the extremes. This stops a few very hot or cold pixels
+// from compressing the rest of the scene into a narrow output range.
+// Pixels excluded by Mask are ignored when calculating the
+// percentiles.
+type PercentileAGC struct {
+	Low  float64
+	High float64
+	Mask *Mask
+
+	hist []int
+}
+
+// NewPercentileAGC returns a PercentileAGC which clips the histogram
+// at the low and high percentiles given.
+func NewPercentileAGC(low, high float64) *PercentileAGC {
+	return &PercentileAGC{
+		Low:  low,
+		High: high,
+	}
+}
+
+// Apply writes the contrast adjusted version of src to dst, which
+// must have the same bounds.
+func (a *PercentileAGC) Apply(src *image.Gray16, dst *image.Gray) {
+	if a.hist == nil {
+		a.hist = make([]int, math.MaxUint16+1)
+	} else {
+		for i := range a.hist {
+			a.hist[i] = 0
+		}
+	}
+
+	count := 0
+	forEachGray16(src, func(x, y int, val uint16) {
+		if a.Mask.Masked(x, y) {
+			return
+		}
+		a.hist[val]++
+		count++
+	})
+	if count == 0 {
+		return
+	}
+
+	lowCount := int(float64(count) * clampPercent(a.Low) / 100)
+	highCount := int(math.Ceil(float64(count) * clampPercent(a.High) / 100))
+	minVal, maxVal := uint16(0), uint16(math.MaxUint16)
+	seen := 0
+	foundMin := false
+	for val, n := range a.hist {
+		if n == 0 {
+			continue
+		}
+		seen += n
+		if !foundMin && seen > lowCount {
+			minVal = uint16(val)
+			foundMin = true
+		}
+		if seen >= highCount {
+			maxVal = uint16(val)
+			break
+		}
+	}
+	stretch(src, dst, minVal, maxVal)
+}
+
+// HistEqAGC performs histogram equalisation, spreading the pixel
+// values so that each output level is used roughly equally. This
+// brings out detail in scenes with a wide temperature range. Pixels
+// excluded by Mask don't contribute to the histogram.
+type HistEqAGC struct {
+	Mask *Mask
+
+	hist []uint32
+}
+
+// Apply writes the equalised version of src to dst, which must have
+// the same bounds.
+func (a *HistEqAGC) Apply(src *image.Gray16, dst *image.Gray) {
+	if a.hist == nil {
+		a.hist = make([]uint32, math.MaxUint16+1)
+	} else {
+		for i := range a.hist {
+			a.hist[i] = 0
+		}
+	}
+
+	var count uint32
+	forEachGray16(src, func(x, y int, val uint16) {
+		if a.Mask.Masked(x, y) {
+			return
+		}
+		a.hist[val]++
+		count++
+	})
+	if count == 0 {
+		return
+	}
+
+	// Convert the histogram into a cumulative distribution.
+	var cumulative uint32
+	for i, n := range a.hist {
+		cumulative += n
+		a.hist[i] = cumulative
+	}
+
+	forEachGray16(src, func(x, y int, val uint16) {
+		dst.Pix[dst.PixOffset(x, y)] = uint8(uint64(a.hist[val]) * 255 / uint64(count))
+	})
+}
+
+func clampPercent(p float64) float64 {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// stretch linearly maps the pixel values in src between minVal and
+// maxVal to 0-255 in dst. Values outside the range are clipped.
+func stretch(src *image.Gray16, dst *image.Gray, minVal, maxVal uint16) {
+	span := float64(maxVal) - float64(minVal)
+	if span <= 0 {
+		span = 1
+	}
+	scale := 255 / span
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := src.PixOffset(b.Min.X, y)
+		j := dst.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			val := binary.BigEndian.Uint16(src.Pix[i:])
+			var out uint8
+			if val >= maxVal {
+				out = 255
+			} else if val > minVal {
+				out = uint8(float64(val-minVal)*scale + 0.5)
+			}
+			dst.Pix[j] = out
+			i += 2
+			j++
+		}
+	}
+}
+
+// forEachGray16 calls fn with the coordinates and value of every
+// pixel in img.
+func forEachGray16(img *image.Gray16, fn func(x, y int, val uint16)) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			fn(x, y, binary.BigEndian.Uint16(img.Pix[i:]))
+			i += 2
+		}
+	}
+}
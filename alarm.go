@@ -0,0 +1,120 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"image"
+)
+
+// TempAlarm configures over and under temperature alarms, which are
+// checked against every frame read by NextFrame. This suits monitoring
+// applications such as detecting overheating equipment or freezing.
+// Alarms are only checked when the camera is producing radiometric
+// output (see Radiometric).
+type TempAlarm struct {
+	// HighC is the temperature above which the alarm fires. Use
+	// math.Inf(1) to disable the high alarm.
+	HighC float64
+
+	// LowC is the temperature below which the alarm fires. Use
+	// math.Inf(-1) to disable the low alarm.
+	LowC float64
+
+	// Region limits the pixels checked (e.g. to a spot-meter
+	// region). The whole frame is checked if it is empty.
+	Region image.Rectangle
+
+	// Handler is called from NextFrame, before it returns the frame,
+	// for each alarm triggered. It must not call NextFrame.
+	Handler func(Alarm)
+}
+
+// Alarm describes the pixel which triggered a temperature alarm. For
+// a high alarm this is the hottest pixel, and for a low alarm the
+// coldest.
+type Alarm struct {
+	High  bool // true for a high alarm, false for a low alarm
+	X, Y  int
+	Raw   uint16
+	TempC float64
+}
+
+// SetTempAlarm enables temperature alarms using the configuration
+// given. Passing nil disables them (the default). The thresholds are
+// converted to raw pixel values using the camera's TempConverter when
+// SetTempAlarm is called, so it should be called again if the
+// converter's settings are changed.
+func (d *Lepton3) SetTempAlarm(cfg *TempAlarm) error {
+	if cfg == nil {
+		d.alarm = nil
+		return nil
+	}
+	if cfg.Handler == nil {
+		return errors.New("alarm handler must be set")
+	}
+	if cfg.LowC > cfg.HighC {
+		return errors.New("low alarm threshold is above the high threshold")
+	}
+	region := cfg.Region
+	if region.Empty() {
+		region = image.Rect(0, 0, FrameCols, FrameRows)
+	}
+	if !region.In(image.Rect(0, 0, FrameCols, FrameRows)) {
+		return errors.New("alarm region must lie within the frame")
+	}
+	highRaw, err := d.tempConv.FromCelsius(cfg.HighC)
+	if err != nil {
+		return err
+	}
+	lowRaw, err := d.tempConv.FromCelsius(cfg.LowC)
+	if err != nil {
+		return err
+	}
+	d.alarm = &alarmState{
+		cfg:     *cfg,
+		region:  region,
+		highRaw: highRaw,
+		lowRaw:  lowRaw,
+	}
+	return nil
+}
+
+type alarmState struct {
+	cfg     TempAlarm
+	region  image.Rectangle
+	highRaw uint16
+	lowRaw  uint16
+}
+
+// alarmRegion returns the region of frames to find the hottest and
+// coldest pixels in for checkAlarms, which is empty if alarms aren't
+// being checked.
+func (d *Lepton3) alarmRegion() image.Rectangle {
+	if d.alarm == nil || !d.tlinear {
+		return image.Rectangle{}
+	}
+	return d.alarm.region
+}
+
+// checkAlarms checks the hottest and coldest pixels of a frame, found
+// by framePixelStats, against the alarm thresholds. The comparisons
+// are done on raw values so that the frame doesn't need converting to
+// temperatures.
+func (d *Lepton3) checkAlarms(hot, cold Alarm) {
+	a := d.alarm
+	if a == nil || !d.tlinear {
+		return
+	}
+	if hot.Raw > a.highRaw {
+		hot.High = true
+		hot.TempC = d.tempConv.PixelToCelsius(hot.X, hot.Y, hot.Raw)
+		a.cfg.Handler(hot)
+	}
+	if cold.Raw < a.lowRaw {
+		cold.TempC = d.tempConv.PixelToCelsius(cold.X, cold.Y, cold.Raw)
+		a.cfg.Handler(cold)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"image"
+)
+
+// Blob describes a connected region of hot pixels.
+type Blob struct {
+	Bounds image.Rectangle
+	Pixels int     // number of pixels in the region
+	Mean   float64 // mean raw pixel value
+
+	// MeanC is the mean temperature of the region in Celsius. It is
+	// only set by Lepton3.WarmestBlob.
+	MeanC float64
+}
+
+// FindBlob finds the largest region of connected pixels (horizontally
+// or vertically adjacent) in img with values above threshold. This is
+// useful for detecting people or overheating components. false is
+// returned if no pixels are above threshold.
+func FindBlob(img *image.Gray16, threshold uint16) (Blob, bool) {
+	blob, _, ok := findBlob(img, threshold)
+	return blob, ok
+}
+
+// WarmestBlob is like FindBlob but finds the largest region of a raw
+// frame warmer than thresholdC, and also reports the region's mean
+// temperature. ErrNotRadiometric is returned if the camera isn't
+// producing radiometric output.
+func (d *Lepton3) WarmestBlob(raw []byte, thresholdC float64) (Blob, bool, error) {
+	if !d.Radiometric() {
+		return Blob{}, false, ErrNotRadiometric
+	}
+	threshold, err := d.tempConv.FromCelsius(thresholdC)
+	if err != nil {
+		return Blob{}, false, err
+	}
+	img := NewRawImage(raw).Freeze()
+	blob, pixels, ok := findBlob(img, threshold)
+	if !ok {
+		return Blob{}, false, nil
+	}
+	var sum float64
+	for _, p := range pixels {
+		x, y := int(p)%FrameCols, int(p)/FrameCols
+		sum += d.tempConv.PixelToCelsius(x, y, img.Gray16At(x, y).Y)
+	}
+	blob.MeanC = sum / float64(len(pixels))
+	return blob, true, nil
+}
+
+// findBlob implements FindBlob using a flood fill from each unvisited
+// hot pixel. It also returns the indexes (y*width+x, relative to the
+// image bounds) of the pixels in the largest region.
+func findBlob(img *image.Gray16, threshold uint16) (Blob, []int32, bool) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	value := func(i int) uint16 {
+		return binary.BigEndian.Uint16(img.Pix[img.PixOffset(b.Min.X+i%w, b.Min.Y+i/w):])
+	}
+	hot := func(i int) bool {
+		return value(i) > threshold
+	}
+
+	visited := make([]bool, w*h)
+	var best, region, stack []int32
+	push := func(i int) {
+		if !visited[i] && hot(i) {
+			visited[i] = true
+			stack = append(stack, int32(i))
+		}
+	}
+	for start := range visited {
+		if visited[start] || !hot(start) {
+			continue
+		}
+		region = region[:0]
+		stack = stack[:0]
+		push(start)
+		for len(stack) > 0 {
+			i := int(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			region = append(region, int32(i))
+			x, y := i%w, i/w
+			if x > 0 {
+				push(i - 1)
+			}
+			if x < w-1 {
+				push(i + 1)
+			}
+			if y > 0 {
+				push(i - w)
+			}
+			if y < h-1 {
+				push(i + w)
+			}
+		}
+		if len(region) > len(best) {
+			best = append(best[:0], region...)
+		}
+	}
+	if len(best) == 0 {
+		return Blob{}, nil, false
+	}
+
+	blob := Blob{Pixels: len(best)}
+	var sum uint64
+	for n, p := range best {
+		i := int(p)
+		x, y := b.Min.X+i%w, b.Min.Y+i/w
+		r := image.Rect(x, y, x+1, y+1)
+		if n == 0 {
+			blob.Bounds = r
+		} else {
+			blob.Bounds = blob.Bounds.Union(r)
+		}
+		sum += uint64(value(i))
+	}
+	blob.Mean = float64(sum) / float64(len(best))
+	return blob, best, true
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"time"
+
+	tomb "gopkg.in/tomb.v2"
+)
+
+// BufferPolicy controls what happens when NextFrame isn't keeping up
+// with the camera and the buffer of packets waiting to be processed
+// fills.
+type BufferPolicy int
+
+const (
+	// BufferBlock pauses reading from the camera until there is
+	// space in the buffer. No buffered packets are lost, but latency
+	// builds up and the camera will usually lose sync if NextFrame
+	// falls far enough behind. This is the default.
+	BufferBlock BufferPolicy = iota
+
+	// BufferDropOldest discards the oldest buffered packet to make
+	// space, so NextFrame always works with the freshest data. This
+	// suits latency sensitive viewers which would rather lose frames.
+	// Dropped packets are counted in Stats, and NextFrame restarts
+	// assembly at the next segment after a drop.
+	BufferDropOldest
+)
+
+// SetPacketBuffer sets the number of packets buffered between the SPI
+// streaming goroutine and NextFrame, and what happens when the buffer
+// is full. size 0 selects the default size. Takes effect the next time
+// the camera is opened.
+func (d *Lepton3) SetPacketBuffer(size int, policy BufferPolicy) error {
+	if size == 0 {
+		size = packetChSize
+	}
+	maxSize := maxPacketBuffer(d.ring)
+	if size < packetsPerSegment || size > maxSize {
+		return fmt.Errorf("packet buffer size must be between %d and %d", packetsPerSegment, maxSize)
+	}
+	if policy != BufferBlock && policy != BufferDropOldest {
+		return fmt.Errorf("invalid buffer policy: %d", policy)
+	}
+	d.packetBufSize = size
+	d.bufferPolicy = policy
+	return nil
+}
+
+// rxPacket is a packet passed from the streaming goroutine to
+// NextFrame, along with when it was read from the camera. Packets are
+// numbered in the order they're sent by seq, starting from 1, so that
+// NextFrame can tell when some have been dropped. With
+// BufferDropOldest the data is in a slot of its own, which is handed
+// back to the streaming goroutine on free once it has been processed.
+type rxPacket struct {
+	data   []byte
+	readAt time.Time
+	seq    uint32
+	free   chan<- []byte
+}
+
+// release hands the packet's slot back to the streaming goroutine, if
+// it has one. free has room for every slot so this never blocks.
+func (p rxPacket) release() {
+	if p.free != nil {
+		p.free <- p.data
+	}
+}
+
+// newPacketSlots returns a channel holding n packet sized slots.
+func newPacketSlots(n int) chan []byte {
+	buf := make([]byte, n*vospiPacketSize)
+	slots := make(chan []byte, n)
+	for i := 0; i < n; i++ {
+		slots <- buf[i*vospiPacketSize : (i+1)*vospiPacketSize]
+	}
+	return slots
+}
+
+// sendPacket passes a packet from the streaming goroutine to
+// NextFrame according to the buffer policy.
+func (d *Lepton3) sendPacket(packet rxPacket, policy BufferPolicy) error {
+	if policy == BufferDropOldest {
+		// The stream doesn't wait for NextFrame, so the transfer
+		// ring soon wraps around onto packets which are still
+		// buffered or being processed. Copy each packet into a
+		// slot of its own instead.
+		slot := d.packetSlot()
+		copy(slot, packet.data)
+		packet.data, packet.free = slot, d.freePackets
+		for {
+			select {
+			case d.packetCh <- packet:
+				return nil
+			default:
+			}
+			select {
+			case old := <-d.packetCh:
+				d.countDroppedPacket()
+				old.release()
+			default:
+			}
+		}
+	}
+	select {
+	case <-d.tomb.Dying():
+		return tomb.ErrDying
+	case d.packetCh <- packet:
+		return nil
+	}
+}
+
+// packetSlot returns a free slot for a packet, dropping the oldest
+// buffered packet to reuse its slot if they're all in use. There is a
+// slot for every packet in packetCh and one for the packet NextFrame
+// is processing, so the buffer is full whenever none are free.
+func (d *Lepton3) packetSlot() []byte {
+	for {
+		select {
+		case slot := <-d.freePackets:
+			return slot
+		default:
+		}
+		select {
+		case old := <-d.packetCh:
+			d.countDroppedPacket()
+			return old.data
+		default:
+		}
+	}
+}
+
+// maxPacketBuffer returns the largest packet buffer which can be used
+// with a transfer ring. Buffered packets refer to the ring so it must
+// not wrap around onto them, allowing for the transfer in progress and
+// the packet being processed.
+func maxPacketBuffer(r *ring) int {
+	packets := r.chunkSize / vospiPacketSize
+	return (r.numChunks - 2) * packets
+}
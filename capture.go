@@ -0,0 +1,327 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+const (
+	captureMinBackoff  = 500 * time.Millisecond
+	captureMaxBackoff  = 30 * time.Second
+	captureMaxFailures = 10
+)
+
+// errStreamStopped is used by RunCapture when NextFrame returns
+// without a frame because the stream was stopped under it.
+var errStreamStopped = errors.New("stream stopped")
+
+// FatalError is returned by RunCapture when the camera couldn't be
+// recovered, even after repeated attempts to reopen it.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("unrecoverable camera failure: %v", e.Err)
+}
+
+// SetChangeThreshold makes RunCapture suppress frames which barely
+// differ from the last frame passed to its handler, reducing
+// processing and storage for mostly static scenes. Frames are only
+// passed on when the mean absolute difference per pixel (in raw
+// counts) from the last frame passed on is at least threshold. To show
+// that the camera is still running, a frame is always passed on if
+// none has been for keyframeInterval. A threshold of 0 disables
+// suppression (the default).
+func (d *Lepton3) SetChangeThreshold(threshold float64, keyframeInterval time.Duration) error {
+	if threshold < 0 {
+		return fmt.Errorf("invalid change threshold: %v", threshold)
+	}
+	if threshold > 0 && keyframeInterval <= 0 {
+		return errors.New("keyframe interval must be positive")
+	}
+	d.changeThreshold = threshold
+	d.keyframeInterval = keyframeInterval
+	return nil
+}
+
+// changeFilter tracks the last frame passed on by RunCapture to
+// implement SetChangeThreshold.
+type changeFilter struct {
+	threshold float64
+	interval  time.Duration
+	last      *image.Gray16
+	lastTime  time.Time
+	diff      []int16
+}
+
+func newChangeFilter(threshold float64, interval time.Duration) *changeFilter {
+	return &changeFilter{
+		threshold: threshold,
+		interval:  interval,
+		diff:      make([]int16, FrameCols*FrameRows),
+	}
+}
+
+// changed returns true if img should be passed on, recording it as
+// the last frame if so.
+func (f *changeFilter) changed(img *image.Gray16) bool {
+	if f.threshold <= 0 {
+		return true
+	}
+	now := time.Now()
+	if f.last != nil && now.Sub(f.lastTime) < f.interval {
+		if err := DiffFramesInto(img, f.last, f.diff); err == nil {
+			var sum int64
+			for _, v := range f.diff {
+				if v < 0 {
+					sum -= int64(v)
+				} else {
+					sum += int64(v)
+				}
+			}
+			if float64(sum)/float64(len(f.diff)) < f.threshold {
+				return false
+			}
+		}
+	}
+	if f.last == nil {
+		f.last = NewGray16()
+	}
+	copy(f.last.Pix, img.Pix)
+	f.lastTime = now
+	return true
+}
+
+// RunCapture opens the camera and calls handler with every frame read
+// until ctx is cancelled. If reading fails the camera is closed and
+// reopened, backing off exponentially between attempts. If the camera
+// fails repeatedly without producing a frame, a *FatalError is
+// returned. The camera can also be power cycled after repeated
+// failures (see SetPowerCycle). ErrWarmingUp, ErrStaleFrame and
+// ErrStuckImage from NextFrame aren't treated as failures: capturing
+// continues on the open stream, and a stuck image is still passed to
+// handler.
+//
+// The image passed to handler is reused for every frame so it must
+// not be retained after handler returns; use CloneGray16 to keep a
+// copy. If handler returns an error,
+// capturing stops and that error is returned. When ctx is cancelled
+// ctx.Err() is returned. Cancellation is checked between frames.
+//
+// Frames which barely change can be suppressed using
+// SetChangeThreshold.
+//
+// RunCapture must not be called if the camera is already open. The
+// camera is closed when RunCapture returns.
+func (d *Lepton3) RunCapture(ctx context.Context, handler func(*image.Gray16) error) error {
+	frame := cptvframe.NewFrame(d)
+	img := NewGray16()
+	filter := newChangeFilter(d.changeThreshold, d.keyframeInterval)
+	return d.runCapture(ctx, func(rawFrame []byte) error {
+		if err := ParseRawFrame(rawFrame, frame); err != nil {
+			d.logf(LogWarn, "failed to parse frame: %v", err)
+			return nil
+		}
+		ToGray16(frame, img)
+		if !filter.changed(img) {
+			return nil
+		}
+		return handler(img)
+	})
+}
+
+// runCapture implements the camera management and retry logic of
+// RunCapture, calling handler with every raw frame read.
+func (d *Lepton3) runCapture(ctx context.Context, handler func([]byte) error) error {
+	if d.IsOpen() {
+		return errors.New("can't run capture while streaming is already active")
+	}
+	rawFrame := NewRawFrame()
+
+	open := false
+	defer func() {
+		if open {
+			d.Close()
+		}
+	}()
+
+	backoff := captureMinBackoff
+	failures := 0
+	fail := func(err error) error {
+		failures++
+		if failures >= captureMaxFailures {
+			return &FatalError{Err: err}
+		}
+		d.logf(LogWarn, "capture failed (attempt %d), retrying in %v: %v", failures, backoff, err)
+		if d.powerCycle != nil && failures%d.powerCycle.Failures == 0 {
+			d.logf(LogWarn, "power cycling camera")
+			if err := d.PowerCycle(); err != nil {
+				d.logf(LogError, "power cycle failed: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > captureMaxBackoff {
+			backoff = captureMaxBackoff
+		}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !open {
+			if err := d.Open(); err != nil {
+				d.Close()
+				if err := fail(err); err != nil {
+					return err
+				}
+				continue
+			}
+			open = true
+		}
+
+		seq := d.frameSeq
+		err := d.NextFrame(rawFrame)
+		if err == nil && d.frameSeq == seq {
+			// The frame wasn't updated so must not be passed on.
+			err = errStreamStopped
+		}
+		if err == ErrWarmingUp || err == ErrStaleFrame {
+			// The stream is still running, so keep reading
+			// rather than reopening the camera.
+			d.logf(LogDebug, "no new frame: %v", err)
+			continue
+		} else if err == ErrStuckImage {
+			// A real frame was read; the caller chose to only
+			// have stuck images reported.
+			d.logf(LogWarn, "%v", err)
+		} else if err != nil {
+			d.Close()
+			open = false
+			if err := fail(err); err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		backoff = captureMinBackoff
+
+		if err := handler(rawFrame); err != nil {
+			return err
+		}
+	}
+}
+
+// CaptureFor is like RunCapture but stops after the duration given,
+// closing the camera. This suits scheduled short captures. The number
+// of frames passed to handler is returned. Reaching the end of the
+// duration isn't treated as an error, but cancellation of ctx is.
+func (d *Lepton3) CaptureFor(ctx context.Context, duration time.Duration, handler func(*image.Gray16) error) (int, error) {
+	sessionCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	frames := 0
+	err := d.RunCapture(sessionCtx, func(img *image.Gray16) error {
+		frames++
+		return handler(img)
+	})
+	return frames, sessionErr(ctx, err)
+}
+
+// RecordFor records raw frames from the camera to w (using a
+// Recorder) for the duration given, then closes the camera and
+// finalises the recording. The number of frames recorded is returned.
+// Every frame is recorded; SetChangeThreshold doesn't apply. If
+// capturing fails the frames recorded so far are still finalised so
+// that the recording is readable.
+func (d *Lepton3) RecordFor(ctx context.Context, duration time.Duration, w io.Writer) (int, error) {
+	rec, err := NewRecorder(w)
+	if err != nil {
+		return 0, err
+	}
+	sessionCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	err = sessionErr(ctx, d.runCapture(sessionCtx, rec.WriteFrame))
+	if closeErr := rec.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return rec.Frames(), err
+}
+
+// sessionErr filters out the error caused by a capture session
+// reaching the end of its duration, unless the parent context was
+// also done.
+func sessionErr(parent context.Context, err error) error {
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		return nil
+	}
+	return err
+}
+
+// BatchStride is the number of values per frame in the slice returned
+// by CaptureBatch.
+const BatchStride = FrameCols * FrameRows
+
+// CaptureBatch reads n consecutive frames into a single contiguous
+// slice, which suits processing pipelines that prefer one large
+// buffer. Frame i occupies [i*BatchStride, (i+1)*BatchStride) and is
+// stored in row major order (i.e. the pixel at (x, y) of frame i is at
+// i*BatchStride + y*FrameCols + x). Resyncs are handled by NextFrame
+// as usual. The camera must be open.
+func (d *Lepton3) CaptureBatch(n int) ([]uint16, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid batch size: %d", n)
+	}
+	out := make([]uint16, n*BatchStride)
+	raw := NewRawFrame()
+	for i := 0; i < n; i++ {
+		if err := d.NextFrame(raw); err != nil {
+			return nil, err
+		}
+		parseRawPixels(raw, out[i*BatchStride:(i+1)*BatchStride])
+	}
+	return out, nil
+}
+
+// NextFrameAt reads frames until one is found with a telemetry frame
+// counter at or beyond count, which is then written into outFrame.
+// This allows captures to be aligned with externally timestamped
+// events when the host and camera clocks have been correlated. Frames
+// before the target are discarded. Counter wraparound is handled. An
+// error is returned if the target isn't reached within timeout.
+// Telemetry must be enabled and the camera must be open.
+func (d *Lepton3) NextFrameAt(outFrame []byte, count uint32, timeout time.Duration) error {
+	if !d.frameBuilder.telemetry.enabled() {
+		return errors.New("frame counter requires telemetry to be enabled")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := d.NextFrame(outFrame); err != nil {
+			return err
+		}
+		got := rawFrameCount(outFrame)
+		if int32(got-count) >= 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for frame %d (last was %d)", count, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errStopCapture = errors.New("stop")
+
+func TestRunCaptureWarmingUp(t *testing.T) {
+	spiConn := new(fakeSPI)
+	// Long enough for NextFrame to report warming up a few times.
+	for i := 0; i < 3*warmupFrames*segmentsPerFrame; i++ {
+		spiConn.send(testSegment(TelemetryHeader, 0, 0xa5)...)
+	}
+	spiConn.send(testFrame(TelemetryHeader, 1)...)
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	d.SetWarmupPolicy(WarmupReport)
+	var log testLog
+	d.SetLogFunc(log.log)
+	d.SetLogLevel(LogDebug)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.runCapture(ctx, func(raw []byte) error {
+		if raw[0] != 1 {
+			t.Errorf("unexpected frame data: %d", raw[0])
+		}
+		return errStopCapture
+	})
+	if err != errStopCapture {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	if n := atomic.LoadInt32(&spiConn.connects); n != 1 {
+		t.Errorf("camera opened %d times, want 1", n)
+	}
+	if log.count(ErrWarmingUp.Error()) == 0 {
+		t.Error("warming up wasn't reported")
+	}
+}
+
+func TestRunCaptureStuckImage(t *testing.T) {
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	if err := d.SetStuckDetection(2, StuckReport); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	frames := 0
+	err := d.runCapture(ctx, func(raw []byte) error {
+		frames++
+		if frames == 5 {
+			return errStopCapture
+		}
+		return nil
+	})
+	if err != errStopCapture {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	if n := atomic.LoadInt32(&spiConn.connects); n != 1 {
+		t.Errorf("camera opened %d times, want 1", n)
+	}
+	if d.Stats().Counters.StuckImages == 0 {
+		t.Error("stuck image wasn't detected")
+	}
+}
+
+func TestRunCaptureStreamStopped(t *testing.T) {
+	spiConn := &fakeSPI{entered: make(chan struct{}, 1)}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- d.runCapture(ctx, func(raw []byte) error {
+			t.Error("handler called without a frame")
+			return errStopCapture
+		})
+	}()
+	select {
+	case <-spiConn.entered:
+	case <-time.After(time.Second):
+		t.Fatal("no transfer started")
+	}
+	// Stop the stream while NextFrame is waiting for packets.
+	d.tomb.Kill(nil)
+
+	// The camera should be reopened rather than a frame passed on.
+	for atomic.LoadInt32(&spiConn.connects) < 2 {
+		select {
+		case err := <-done:
+			t.Fatalf("capture stopped: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
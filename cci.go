@@ -0,0 +1,372 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+// Some source code in this file comes from the periph project
+// (https://periph.io/).
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/mmr"
+)
+
+// cciConn implements the low level GET, SET and RUN protocol of the
+// Lepton's Command and Control Interface. It is used for commands
+// which periph's cci package doesn't expose.
+//
+// Each operation takes a context, which cancels waiting for the camera
+// to become idle. Commands are only ever abandoned while waiting, so
+// the CCI is never left with a command partly written.
+type cciConn struct {
+	mu sync.Mutex
+	r  mmr.Dev16
+}
+
+func newCCIConn(bus i2c.Bus) *cciConn {
+	return &cciConn{
+		r: mmr.Dev16{Conn: &i2c.Dev{Bus: bus, Addr: cciAddr}, Order: Big16},
+	}
+}
+
+// waitIdle waits for the busy bit to clear, returning the status
+// register. It gives up if ctx is cancelled.
+func (c *cciConn) waitIdle(ctx context.Context) (uint16, error) {
+	timeout := time.After(cciBusyTimeout)
+	for {
+		s, err := c.r.ReadUint16(regStatus)
+		if err != nil || s&statusBusy == 0 {
+			return s, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout:
+			return 0, errors.New("timed out waiting for CCI idle")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// get reads the value of an attribute into data, which must be a
+// pointer to a fixed size value of at most 16 words.
+func (c *cciConn) get(ctx context.Context, cmd cciCommand, data interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.waitIdle(ctx); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regDataLength, uint16(cmd.words)); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regCommandID, cmd.id); err != nil {
+		return err
+	}
+	if err := c.result(ctx, cmd); err != nil {
+		return err
+	}
+	return c.r.ReadStruct(regData0, data)
+}
+
+// set writes data to an attribute.
+func (c *cciConn) set(ctx context.Context, cmd cciCommand, data interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.waitIdle(ctx); err != nil {
+		return err
+	}
+	if err := c.r.WriteStruct(regData0, data); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regDataLength, uint16(cmd.words)); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regCommandID, cmd.id|cciTypeSet); err != nil {
+		return err
+	}
+	return c.result(ctx, cmd)
+}
+
+// run runs a command which takes no arguments.
+func (c *cciConn) run(ctx context.Context, cmd cciCommand) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.waitIdle(ctx); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regDataLength, 0); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regCommandID, cmd.id|cciTypeRun); err != nil {
+		return err
+	}
+	return c.result(ctx, cmd)
+}
+
+// setTelemetryLayout configures whether the camera sends telemetry and
+// where.
+func (c *cciConn) setTelemetryLayout(ctx context.Context, layout TelemetryLayout) error {
+	enable := uint32(0)
+	if layout.enabled() {
+		enable = 1
+	}
+	if err := c.set(ctx, sysTelemetry, &enable); err != nil {
+		return err
+	}
+	if !layout.enabled() {
+		return nil
+	}
+	location := uint32(0) // header
+	if layout == TelemetryFooter {
+		location = 1
+	}
+	return c.set(ctx, sysTelemetryLoc, &location)
+}
+
+// send issues a command which takes no arguments without waiting for
+// the result. This is needed for commands such as a reboot, after
+// which the camera doesn't respond.
+func (c *cciConn) send(ctx context.Context, cmd cciCommand) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.waitIdle(ctx); err != nil {
+		return err
+	}
+	if err := c.r.WriteUint16(regDataLength, 0); err != nil {
+		return err
+	}
+	return c.r.WriteUint16(regCommandID, cmd.id|cciTypeRun)
+}
+
+// waitBooted waits for the camera to report that it has booted and is
+// idle. Read errors are ignored until the timeout expires as the
+// camera doesn't respond over I2C while it boots.
+func (c *cciConn) waitBooted(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expired := time.After(timeout)
+	for {
+		s, err := c.r.ReadUint16(regStatus)
+		if err == nil && s&(statusBusy|statusBootMask) == statusBootMask {
+			return nil
+		}
+		select {
+		case <-expired:
+			return errors.New("timed out waiting for camera to boot")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *cciConn) result(ctx context.Context, cmd cciCommand) error {
+	s, err := c.waitIdle(ctx)
+	if err != nil {
+		return err
+	}
+	if s&statusErrorMask != 0 {
+		return &cciError{cmd: cmd.id, code: int8(s >> 8)}
+	}
+	return nil
+}
+
+// cciError is returned when the camera reports that a command failed.
+// code is the camera's (negative) LEP_RESULT.
+type cciError struct {
+	cmd  uint16
+	code int8
+}
+
+func (e *cciError) Error() string {
+	return fmt.Sprintf("cci: command 0x%04x failed with error %d", e.cmd, e.code)
+}
+
+// unsupported returns true if the command doesn't exist on this
+// camera model.
+func (e *cciError) unsupported() bool {
+	return e.code == lepUndefinedFunction || e.code == lepFunctionNotSupported
+}
+
+// tlinearEnabled returns whether the camera is producing TLinear
+// output. Non-radiometric models fail the command with an error for
+// which unsupported returns true.
+func (c *cciConn) tlinearEnabled(ctx context.Context) (bool, error) {
+	var enabled uint32
+	if err := c.get(ctx, radTLinearEnable, &enabled); err != nil {
+		return false, err
+	}
+	return enabled != 0, nil
+}
+
+const (
+	cciAddr        = 0x2A
+	cciBusyTimeout = 500 * time.Millisecond
+
+	// How often WaitFFC checks the FFC status.
+	ffcPollInterval = 50 * time.Millisecond
+
+	// Registers
+	regStatus     uint16 = 2
+	regCommandID  uint16 = 4
+	regDataLength uint16 = 6
+	regData0      uint16 = 8
+
+	// Status register bits
+	statusBusy      uint16 = 0x1
+	statusBootMask  uint16 = 0x6 // boot mode normal and booted
+	statusErrorMask uint16 = 0xFF00
+
+	// Command types (OR'd with the command ID)
+	cciTypeSet uint16 = 1
+	cciTypeRun uint16 = 2
+
+	// LEP_RESULT codes reported for commands a model doesn't have
+	lepUndefinedFunction    int8 = -7
+	lepFunctionNotSupported int8 = -8
+
+	// TLinear resolution settings (radTLinearResolution)
+	radResolution01  uint32 = 0 // 0.1 K per count
+	radResolution001 uint32 = 1 // 0.01 K per count
+)
+
+// cciCommand is a CCI command ID along with the number of 16 bit words
+// of data it transfers.
+type cciCommand struct {
+	id    uint16
+	words int
+}
+
+var (
+	agcEnable            = cciCommand{0x0100, 2}
+	agcROISelect         = cciCommand{0x0108, 4}
+	sysTelemetry         = cciCommand{0x0218, 2}
+	sysTelemetryLoc      = cciCommand{0x021C, 2}
+	sysSceneStats        = cciCommand{0x022C, 4}
+	sysFFCRun            = cciCommand{0x0240, 0}
+	sysFFCStatus         = cciCommand{0x0244, 2}
+	sysGainMode          = cciCommand{0x0248, 2}
+	oemPartNumber        = cciCommand{0x481C, 16}
+	oemSWRevision        = cciCommand{0x4820, 4}
+	oemReboot            = cciCommand{0x4840, 0}
+	radTLinearEnable     = cciCommand{0x4EC0, 2}
+	radTLinearResolution = cciCommand{0x4EC4, 2}
+)
+
+// cciBytes unpacks byte arrays (such as strings) read over CCI. The
+// camera's SDK stores the data words in little endian order, so the
+// first byte of each pair is the low byte of the word.
+func cciBytes(words []uint16) []byte {
+	out := make([]byte, 0, len(words)*2)
+	for _, w := range words {
+		out = append(out, byte(w), byte(w>>8))
+	}
+	return out
+}
+
+// SceneStats holds the scene statistics calculated by the camera
+// itself over its scene statistics region of interest. These are
+// computed on the pre-AGC frame.
+type SceneStats struct {
+	Mean      uint16
+	Max       uint16
+	Min       uint16
+	NumPixels uint16
+}
+
+// cciROI is the wire format of a region of interest. The end row and
+// column are inclusive.
+type cciROI struct {
+	StartCol uint16
+	StartRow uint16
+	EndCol   uint16
+	EndRow   uint16
+}
+
+func roiFromRect(r image.Rectangle) (cciROI, error) {
+	if r.Empty() || !r.In(image.Rect(0, 0, FrameCols, FrameRows)) {
+		return cciROI{}, fmt.Errorf("invalid region of interest: %v", r)
+	}
+	return cciROI{
+		StartCol: uint16(r.Min.X),
+		StartRow: uint16(r.Min.Y),
+		EndCol:   uint16(r.Max.X - 1),
+		EndRow:   uint16(r.Max.Y - 1),
+	}, nil
+}
+
+func (r cciROI) rect() image.Rectangle {
+	return image.Rect(int(r.StartCol), int(r.StartRow), int(r.EndCol)+1, int(r.EndRow)+1)
+}
+
+// FFCStatus is the state of the camera's flat field correction (FFC)
+// process, as reported over CCI.
+type FFCStatus int32
+
+// Valid values for FFCStatus.
+const (
+	FFCStatusWriteError       FFCStatus = -2
+	FFCStatusError            FFCStatus = -1
+	FFCStatusReady            FFCStatus = 0
+	FFCStatusBusy             FFCStatus = 1
+	FFCStatusCollectingFrames FFCStatus = 2
+)
+
+func (s FFCStatus) String() string {
+	switch s {
+	case FFCStatusWriteError:
+		return "write-error"
+	case FFCStatusError:
+		return "error"
+	case FFCStatusReady:
+		return "ready"
+	case FFCStatusBusy:
+		return "busy"
+	case FFCStatusCollectingFrames:
+		return "collecting-frames"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+}
+
+// InProgress returns true if an FFC is currently running.
+func (s FFCStatus) InProgress() bool {
+	return s == FFCStatusBusy || s == FFCStatusCollectingFrames
+}
+
+// FFCState describes the current FFC status along with the time since
+// the last FFC completed.
+type FFCState struct {
+	Status       FFCStatus
+	SinceLastFFC time.Duration
+}
+
+// GainMode is the camera's gain mode, which trades off sensitivity
+// against the range of scene temperatures which can be measured.
+type GainMode uint32
+
+// Valid values for GainMode.
+const (
+	GainHigh GainMode = 0
+	GainLow  GainMode = 1
+	GainAuto GainMode = 2
+)
+
+func (g GainMode) String() string {
+	switch g {
+	case GainHigh:
+		return "high"
+	case GainLow:
+		return "low"
+	case GainAuto:
+		return "auto"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(g))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"time"
+)
+
+// ClockEstimate describes the camera's timing relative to the host
+// clock, estimated by correlating frame telemetry with the time each
+// frame was received.
+type ClockEstimate struct {
+	// Period is the estimated time between frames output by the
+	// camera, measured by the host clock. This is nominally 1/8.7s
+	// but varies slightly between cameras.
+	Period time.Duration
+
+	// Drift is the rate at which the camera's clock runs relative to
+	// the host's, in parts per million. A positive value means the
+	// camera's clock is running slow.
+	Drift float64
+
+	// Epoch is the host time at which the camera's uptime (the TimeOn
+	// telemetry field) was zero. This is the offset between the two
+	// clocks; see HostTime.
+	Epoch time.Time
+
+	// Samples is the number of frames the estimate is based on.
+	Samples int
+}
+
+// HostTime converts a camera uptime, as reported in a frame's
+// telemetry, to the equivalent host time.
+func (e ClockEstimate) HostTime(timeOn time.Duration) time.Time {
+	return e.Epoch.Add(time.Duration(float64(timeOn) * (1 + e.Drift/1e6)))
+}
+
+// SetClockEstimation enables estimation of the camera's frame timing
+// (see ClockEstimate) over a sliding window of the given number of
+// frames. Longer windows give more accurate estimates but respond
+// more slowly to change. A window of 0 disables estimation (the
+// default). Telemetry must be enabled for frames to be sampled.
+func (d *Lepton3) SetClockEstimation(window int) error {
+	if window == 0 {
+		d.clock = nil
+		return nil
+	}
+	if window < 2 {
+		return errors.New("clock estimation window must be at least 2 frames")
+	}
+	d.clock = &clockEstimator{samples: make([]clockSample, 0, window)}
+	return nil
+}
+
+// ClockEstimate returns the current estimate of the camera's frame
+// timing. false is returned if estimation isn't enabled or not enough
+// frames have been sampled yet. Like LastFrameInfo, it should be
+// called from the goroutine calling NextFrame.
+func (d *Lepton3) ClockEstimate() (ClockEstimate, bool) {
+	if d.clock == nil {
+		return ClockEstimate{}, false
+	}
+	return d.clock.estimate()
+}
+
+type clockSample struct {
+	host   time.Time
+	timeOn time.Duration
+	count  uint32
+}
+
+// clockEstimator holds a ring of recent samples.
+type clockEstimator struct {
+	samples []clockSample
+	next    int
+}
+
+func (c *clockEstimator) add(raw []byte, host time.Time) {
+	var tw telemetryWords
+	if tw.decode(raw) != nil {
+		return
+	}
+	s := clockSample{
+		host:   host,
+		timeOn: tw.TimeOn.ToD(),
+		count:  tw.FrameCounter,
+	}
+	if n := len(c.samples); n > 0 {
+		last := c.samples[(c.next+n-1)%n]
+		if s.timeOn < last.timeOn || s.count == last.count {
+			// The camera has rebooted (or the frame was a
+			// repeat), so earlier samples aren't comparable.
+			c.samples = c.samples[:0]
+			c.next = 0
+		}
+	}
+	if len(c.samples) < cap(c.samples) {
+		c.samples = append(c.samples, s)
+		return
+	}
+	c.samples[c.next] = s
+	c.next = (c.next + 1) % len(c.samples)
+}
+
+// estimate fits straight lines, using least squares, to host time
+// against camera uptime (giving the drift and epoch) and against the
+// frame counter (giving the period).
+func (c *clockEstimator) estimate() (ClockEstimate, bool) {
+	n := len(c.samples)
+	if n < 2 {
+		return ClockEstimate{}, false
+	}
+	first := c.samples[c.next%n]
+
+	// Values are taken relative to the first sample to preserve
+	// precision. The frame counter step between output frames is
+	// usually more than 1 as the camera counts frames it doesn't
+	// output.
+	var onFit, countFit lineFit
+	minStep := uint32(0)
+	prev := first
+	for i := 0; i < n; i++ {
+		s := c.samples[(c.next+i)%n]
+		host := s.host.Sub(first.host).Seconds()
+		onFit.add((s.timeOn - first.timeOn).Seconds(), host)
+		countFit.add(float64(s.count-first.count), host)
+		if step := s.count - prev.count; step > 0 && (minStep == 0 || step < minStep) {
+			minStep = step
+		}
+		prev = s
+	}
+	onSlope, onIntercept, ok := onFit.solve()
+	if !ok {
+		return ClockEstimate{}, false
+	}
+	countSlope, _, ok := countFit.solve()
+	if !ok {
+		return ClockEstimate{}, false
+	}
+
+	epoch := first.host.Add(time.Duration((onIntercept - onSlope*first.timeOn.Seconds()) * float64(time.Second)))
+	return ClockEstimate{
+		Period:  time.Duration(countSlope * float64(minStep) * float64(time.Second)),
+		Drift:   (onSlope - 1) * 1e6,
+		Epoch:   epoch,
+		Samples: n,
+	}, true
+}
+
+// lineFit accumulates the sums needed for a least squares straight
+// line fit.
+type lineFit struct {
+	n, x, y, xx, xy float64
+}
+
+func (f *lineFit) add(x, y float64) {
+	f.n++
+	f.x += x
+	f.y += y
+	f.xx += x * x
+	f.xy += x * y
+}
+
+func (f *lineFit) solve() (slope, intercept float64, ok bool) {
+	den := f.n*f.xx - f.x*f.x
+	if den == 0 {
+		return 0, 0, false
+	}
+	slope = (f.n*f.xy - f.x*f.y) / den
+	intercept = (f.y - slope*f.x) / f.n
+	return slope, intercept, true
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Config is a snapshot of the camera's key settings, as read over CCI
+// by DumpConfig. It is intended for diagnostics and support.
+type Config struct {
+	PartNum         string
+	Serial          uint64
+	SoftwareVersion LeptonSoftwareRevision
+	GainMode        GainMode
+	Radiometry      bool
+	TLinear         bool
+	FFCMode         *FFCMode
+	AGCEnabled      bool
+
+	// Unknown holds the fields (by name) which couldn't be read,
+	// along with the reason. The values of these fields in the
+	// Config are meaningless.
+	Unknown map[string]error
+}
+
+// DumpConfig reads the camera's key settings over CCI. Failure to read
+// individual settings doesn't cause DumpConfig to fail; instead the
+// affected fields are recorded in Config.Unknown. An error is only
+// returned if the CCI isn't available at all.
+func (d *Lepton3) DumpConfig() (*Config, error) {
+	if d.cciDev == nil {
+		return nil, errors.New("cant dump config as cciDev is nil, is the camera open?")
+	}
+	c := &Config{Unknown: make(map[string]error)}
+	check := func(field string, err error) {
+		if err != nil {
+			c.Unknown[field] = err
+		}
+	}
+
+	var err error
+	c.PartNum, err = d.GetPartNum()
+	check("PartNum", err)
+	c.Serial, err = d.GetSerial()
+	check("Serial", err)
+	c.SoftwareVersion, err = d.GetSoftwareVersion()
+	check("SoftwareVersion", err)
+	check("GainMode", d.cciDev.regs.get(context.Background(), sysGainMode, &c.GainMode))
+	c.Radiometry, err = d.cciDev.GetRadiometry()
+	check("Radiometry", err)
+	c.TLinear, err = d.GetTLinearEnabled()
+	check("TLinear", err)
+	c.FFCMode, err = d.GetFFCModeControl()
+	check("FFCMode", err)
+	var agc uint32
+	check("AGCEnabled", d.cciDev.regs.get(context.Background(), agcEnable, &agc))
+	c.AGCEnabled = agc != 0
+	return c, nil
+}
+
+// WriteReport writes a human readable version of the configuration to
+// w.
+func (c *Config) WriteReport(w io.Writer) error {
+	field := func(name string, val interface{}) string {
+		if err, ok := c.Unknown[name]; ok {
+			return fmt.Sprintf("%-16s unknown (%v)\n", name+":", err)
+		}
+		return fmt.Sprintf("%-16s %v\n", name+":", val)
+	}
+
+	var b strings.Builder
+	b.WriteString(field("PartNum", c.PartNum))
+	b.WriteString(field("Serial", c.Serial))
+	b.WriteString(field("SoftwareVersion", c.SoftwareVersion))
+	b.WriteString(field("GainMode", c.GainMode))
+	b.WriteString(field("Radiometry", c.Radiometry))
+	b.WriteString(field("TLinear", c.TLinear))
+	if c.FFCMode != nil {
+		b.WriteString(field("FFCMode", fmt.Sprintf("%+v", *c.FFCMode)))
+	} else {
+		b.WriteString(field("FFCMode", nil))
+	}
+	b.WriteString(field("AGCEnabled", c.AGCEnabled))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+// VoSPI packets are protected by a CRC16-CCITT (x^16 + x^12 + x^5 + 1,
+// initial value 0). The CRC covers the whole packet with the 4 most
+// significant bits of the ID field and the CRC field itself set to 0.
+
+const crcPoly = 0x1021
+
+var crcTable = makeCRCTable()
+
+func makeCRCTable() *[256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ crcPoly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return &table
+}
+
+func crcUpdate(crc uint16, b byte) uint16 {
+	return crc<<8 ^ crcTable[byte(crc>>8)^b]
+}
+
+// packetCRC calculates the expected CRC for a VoSPI packet.
+func packetCRC(packet []byte) uint16 {
+	crc := crcUpdate(0, packet[0]&0x0F)
+	crc = crcUpdate(crc, packet[1])
+	crc = crcUpdate(crc, 0)
+	crc = crcUpdate(crc, 0)
+	for _, b := range packet[vospiHeaderSize:] {
+		crc = crcUpdate(crc, b)
+	}
+	return crc
+}
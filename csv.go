@@ -0,0 +1,57 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+// CSVUnits selects the values written by WriteCSV.
+type CSVUnits int
+
+// Valid values for CSVUnits.
+const (
+	CSVRawCounts CSVUnits = iota
+	CSVCelsius
+)
+
+// WriteCSV writes the pixels of frame to w as a CSV grid with one line
+// per image row. Values are either the raw pixel counts or
+// temperatures in Celsius, converted using the camera's
+// TempConverter. Celsius output is only possible when the camera is
+// producing radiometric (TLinear) output.
+func (d *Lepton3) WriteCSV(w io.Writer, frame *cptvframe.Frame, units CSVUnits) error {
+	if units == CSVCelsius && !d.Radiometric() {
+		return ErrNotRadiometric
+	}
+	return writeCSV(w, frame, units, d.tempConv)
+}
+
+func writeCSV(w io.Writer, frame *cptvframe.Frame, units CSVUnits, conv *TempConverter) error {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	for y, row := range frame.Pix {
+		buf = buf[:0]
+		for x, val := range row {
+			if x > 0 {
+				buf = append(buf, ',')
+			}
+			if units == CSVCelsius {
+				buf = strconv.AppendFloat(buf, conv.PixelToCelsius(x, y, val), 'f', 2, 64)
+			} else {
+				buf = strconv.AppendUint(buf, uint64(val), 10)
+			}
+		}
+		buf = append(buf, '\n')
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
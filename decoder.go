@@ -0,0 +1,154 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Decoder assembles raw frames from VoSPI packets which have been
+// obtained by some means other than Lepton3 (e.g. from a file or over
+// the network). It applies the same validation and assembly rules as
+// Lepton3 but leaves recovery from errors to the caller.
+type Decoder struct {
+	// CheckCRC enables checking of packet CRCs.
+	CheckCRC bool
+
+	fb       *frameBuilder
+	complete bool
+}
+
+// NewDecoder returns a new Decoder for the default telemetry layout.
+func NewDecoder() *Decoder {
+	return &Decoder{fb: newFrameBuilder()}
+}
+
+// Decode processes a single packet (vospiPacketSize bytes, including
+// the header). It returns true when a frame has been completed, which
+// can then be retrieved with Frame. Discard packets are ignored.
+//
+// When an error is returned the partially assembled frame is
+// discarded and assembly restarts with the next frame.
+func (d *Decoder) Decode(packet []byte) (bool, error) {
+	if len(packet) != vospiPacketSize {
+		return false, fmt.Errorf("invalid packet length: %d", len(packet))
+	}
+	if d.complete {
+		d.Reset()
+	}
+	if packet[0]&packetHeaderDiscard == packetHeaderDiscard {
+		return false, nil
+	}
+	packetNum, err := checkPacket(packet, d.CheckCRC, !d.CheckCRC)
+	if err != nil {
+		d.Reset()
+		return false, err
+	} else if packetNum < 0 {
+		return false, nil
+	}
+	complete, err := d.fb.nextPacket(packetNum, packet)
+	if err != nil {
+		d.Reset()
+		return false, err
+	}
+	d.complete = complete
+	return complete, nil
+}
+
+// Frame copies the most recently completed frame into raw (see
+// NewRawFrame). It should only be called after Decode returns true.
+// With fewer than 4 segments per frame only the start of raw, up to
+// the size of a frame, is written.
+func (d *Decoder) Frame(raw []byte) {
+	d.fb.output(raw)
+}
+
+// SetAssemblyMode controls how packets are assembled into segments
+// (see AssemblyMode). Any partially assembled frame is discarded.
+func (d *Decoder) SetAssemblyMode(mode AssemblyMode) {
+	d.fb.mode = mode
+	d.Reset()
+}
+
+// SetSegmentsPerFrame sets the number of segments (1 to 4) which make
+// up a frame, for cameras other than the Lepton 3. The default is 4.
+// With a single segment, the segment number in packet 20 is ignored
+// and every complete segment is a frame. Any partially assembled frame
+// is discarded.
+//
+// This is only available on Decoder, for decoding packets from other
+// sources. Lepton3 always reads 4 segment frames, as the Lepton 3
+// sends.
+func (d *Decoder) SetSegmentsPerFrame(n int) error {
+	if err := d.fb.setSegments(n); err != nil {
+		return err
+	}
+	d.complete = false
+	return nil
+}
+
+// Segment returns one of the segments (numbered from 1, see
+// SetSegmentsPerFrame) of the most recently completed frame, for
+// custom processing which treats segments independently. It should
+// only be called after Decode returns true, and the data is only valid
+// until the next call to Decode or Reset.
+//
+// Each segment holds the payloads of its packets in packet order,
+// with the headers removed. Packets hold half an image row each. With
+// TelemetryHeader the first 4 packets of the first segment are
+// telemetry, and with TelemetryFooter the last 4 packets of the last
+// segment are.
+func (d *Decoder) Segment(n int) (Segment, error) {
+	if !d.complete {
+		return nil, errors.New("no complete frame")
+	}
+	if n < 1 || n > d.fb.segments {
+		return nil, fmt.Errorf("invalid segment number: %d", n)
+	}
+	size := len(d.fb.segmentBuf)
+	return Segment(d.fb.frameBuf[(n-1)*size : n*size]), nil
+}
+
+// Segment is the data of a single segment of a frame (see
+// Decoder.Segment).
+type Segment []byte
+
+// Packets returns the number of packets in the segment.
+func (s Segment) Packets() int {
+	return len(s) / vospiDataSize
+}
+
+// Packet returns the payload of packet i of the segment.
+func (s Segment) Packet(i int) []byte {
+	return s[i*vospiDataSize : (i+1)*vospiDataSize]
+}
+
+// Reset discards any partially assembled frame, for example at a
+// stream boundary. The next frame starts with the next segment 1.
+func (d *Decoder) Reset() {
+	d.fb.reset()
+	d.complete = false
+}
+
+// InProgress reports whether a frame is partially assembled, along
+// with the fraction (0-1) of the frame's packets received so far.
+func (d *Decoder) InProgress() (bool, float64) {
+	if d.complete {
+		return false, 1
+	}
+	received := len(d.fb.frameBuf)
+	if d.fb.mode == AssemblyTracked {
+		received += bits.OnesCount64(d.fb.received) * vospiDataSize
+	} else if d.fb.packetNum >= 0 && d.fb.packetNum < d.fb.lastPacket && !d.fb.skipSegment {
+		received += (d.fb.packetNum + 1) * vospiDataSize
+	}
+	if received == 0 {
+		return false, 0
+	}
+	total := d.fb.segments * len(d.fb.segmentBuf)
+	return true, float64(received) / float64(total)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"testing"
+)
+
+// decodeAll passes packets to d, returning the number of frames
+// completed.
+func decodeAll(t *testing.T, d *Decoder, packets [][]byte) int {
+	t.Helper()
+	frames := 0
+	for _, packet := range packets {
+		complete, err := d.Decode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete {
+			frames++
+		}
+	}
+	return frames
+}
+
+func TestDecoderInProgress(t *testing.T) {
+	seg := func(n int) [][]byte {
+		return testSegment(TelemetryHeader, n, 0xa5)
+	}
+	tests := []struct {
+		name    string
+		mode    AssemblyMode
+		stream  [][]byte
+		packets int // packets of the frame in progress
+	}{
+		{"nothing", AssemblySequential, nil, 0},
+		{"start of segment 1", AssemblySequential, seg(1)[:10], 10},
+		{"mid segment 2", AssemblySequential, concatPackets(seg(1), seg(2)[:30]), packetsPerSegment + 30},
+		{"after segment 0", AssemblySequential, concatPackets(seg(0), seg(1)[:10]), 10},
+		{"within segment 0", AssemblySequential, seg(0)[:30], 0},
+		{"segment 0 after segment 1", AssemblySequential, concatPackets(seg(1), seg(0)[:10]), packetsPerSegment + 10},
+		{"segment 0 known after segment 1", AssemblySequential, concatPackets(seg(1), seg(0)[:30]), 0},
+		{"tracked", AssemblyTracked, concatPackets(seg(1), seg(2)[:30]), packetsPerSegment + 30},
+	}
+	for _, tt := range tests {
+		d := NewDecoder()
+		d.CheckCRC = true
+		d.SetAssemblyMode(tt.mode)
+		if frames := decodeAll(t, d, tt.stream); frames != 0 {
+			t.Fatalf("%s: %d frames completed", tt.name, frames)
+		}
+		want := float64(tt.packets) / float64(packetsPerFrame)
+		if inProgress, got := d.InProgress(); inProgress != (tt.packets > 0) || got != want {
+			t.Errorf("%s: InProgress() = %v, %v, want %v, %v", tt.name, inProgress, got, tt.packets > 0, want)
+		}
+
+		// The stream is cut here.
+		d.Reset()
+		if inProgress, got := d.InProgress(); inProgress || got != 0 {
+			t.Errorf("%s: after Reset InProgress() = %v, %v", tt.name, inProgress, got)
+		}
+		if frames := decodeAll(t, d, testFrame(TelemetryHeader, 1)); frames != 1 {
+			t.Errorf("%s: %d frames completed after Reset, want 1", tt.name, frames)
+		}
+		if inProgress, got := d.InProgress(); inProgress || got != 1 {
+			t.Errorf("%s: complete frame InProgress() = %v, %v", tt.name, inProgress, got)
+		}
+	}
+}
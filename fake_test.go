@@ -0,0 +1,347 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/conn/spi/spireg"
+)
+
+// How long a nil entry in a fakeSPI queue pauses the stream for. This
+// is longer than streamPauseThreshold so it looks like an FFC.
+const fakeSPIPause = 2 * streamPauseThreshold
+
+// fakeSPI simulates the camera's end of the SPI connection. Transfers
+// return the queued packets in order. A nil entry in the queue pauses
+// the stream for fakeSPIPause. Once the queue is exhausted the packets
+// in repeat are sent over and over, or discard packets if there are
+// none.
+type fakeSPI struct {
+	mu         sync.Mutex
+	queue      [][]byte
+	repeat     [][]byte
+	pos        int
+	pauseUntil time.Time
+
+	// If entered is set, it is signalled (without blocking) at the
+	// start of every transfer.
+	entered chan struct{}
+
+	// If block is set, every transfer waits to receive from it and
+	// fails with the error received, or succeeds if it is closed.
+	block chan error
+
+	transfers int32 // accessed atomically
+	connects  int32 // accessed atomically
+}
+
+var (
+	_ spi.Conn       = (*fakeSPI)(nil)
+	_ spi.PortCloser = fakeSPIPort{}
+)
+
+func (f *fakeSPI) String() string {
+	return "fakeSPI"
+}
+
+func (f *fakeSPI) Duplex() conn.Duplex {
+	return conn.Full
+}
+
+func (f *fakeSPI) Tx(w, r []byte) error {
+	atomic.AddInt32(&f.transfers, 1)
+	if f.entered != nil {
+		select {
+		case f.entered <- struct{}{}:
+		default:
+		}
+	}
+	if f.block != nil {
+		if err, ok := <-f.block; ok {
+			return err
+		}
+	}
+	paused := f.paused()
+	for i := 0; i+vospiPacketSize <= len(r); i += vospiPacketSize {
+		if paused || !f.nextPacket(r[i:i+vospiPacketSize]) {
+			// The camera only sends discard packets while
+			// paused.
+			fakeDiscardPacket(r[i : i+vospiPacketSize])
+			paused = true
+		}
+	}
+	// Avoid spinning when there's nothing to send.
+	if paused || f.idle() {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// paused returns true if the stream is paused.
+func (f *fakeSPI) paused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.pauseUntil)
+}
+
+func (f *fakeSPI) TxPackets(p []spi.Packet) error {
+	for _, packet := range p {
+		if err := f.Tx(packet.W, packet.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextPacket copies the next packet to send into dst. It returns false
+// if the stream should pause.
+func (f *fakeSPI) nextPacket(dst []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) > 0 {
+		packet := f.queue[0]
+		f.queue = f.queue[1:]
+		if packet == nil {
+			f.pauseUntil = time.Now().Add(fakeSPIPause)
+			return false
+		}
+		copy(dst, packet)
+	} else if len(f.repeat) > 0 {
+		copy(dst, f.repeat[f.pos])
+		f.pos = (f.pos + 1) % len(f.repeat)
+	} else {
+		fakeDiscardPacket(dst)
+	}
+	return true
+}
+
+func (f *fakeSPI) idle() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue) == 0 && len(f.repeat) == 0
+}
+
+// send adds packets to the queue.
+func (f *fakeSPI) send(packets ...[]byte) {
+	f.mu.Lock()
+	f.queue = append(f.queue, packets...)
+	f.mu.Unlock()
+}
+
+func fakeDiscardPacket(dst []byte) {
+	for i := range dst {
+		dst[i] = 0
+	}
+	dst[0] = packetHeaderDiscard
+}
+
+// fakeSPIPort hands out its fakeSPI to Open.
+type fakeSPIPort struct {
+	*fakeSPI
+}
+
+func (p fakeSPIPort) Close() error {
+	return nil
+}
+
+// Connect restarts the repeated packets from the beginning, like the
+// camera restarting its stream at a segment boundary after a resync.
+func (p fakeSPIPort) Connect(maxHz int64, mode spi.Mode, bits int) (spi.Conn, error) {
+	atomic.AddInt32(&p.connects, 1)
+	p.mu.Lock()
+	p.pos = 0
+	p.mu.Unlock()
+	return p.fakeSPI, nil
+}
+
+func (p fakeSPIPort) LimitSpeed(maxHz int64) error {
+	return nil
+}
+
+// fakeCCI simulates the camera's CCI registers. GET commands return
+// the value stored for the command, which SET commands update. RUN
+// commands succeed with no effect.
+type fakeCCI struct {
+	mu    sync.Mutex
+	mem   [0x10000]byte
+	attrs map[uint16][]byte
+
+	// errs gives the error code (a negative LEP_RESULT) to report
+	// for a command.
+	errs map[uint16]int8
+
+	// If busErr is set, every bus transaction fails with it.
+	busErr error
+
+	// The number of times each command has been executed.
+	executed map[uint16]int
+}
+
+var _ i2c.BusCloser = (*fakeCCI)(nil)
+
+func newFakeCCI() *fakeCCI {
+	c := &fakeCCI{
+		attrs:    make(map[uint16][]byte),
+		errs:     make(map[uint16]int8),
+		executed: make(map[uint16]int),
+	}
+	binary.BigEndian.PutUint16(c.mem[regStatus:], statusBootMask)
+	return c
+}
+
+func (c *fakeCCI) String() string {
+	return "fakeCCI"
+}
+
+func (c *fakeCCI) Close() error {
+	return nil
+}
+
+func (c *fakeCCI) SetSpeed(hz int64) error {
+	return nil
+}
+
+func (c *fakeCCI) Tx(addr uint16, w, r []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.busErr != nil {
+		return c.busErr
+	}
+	if addr != cciAddr || len(w) < 2 {
+		return fmt.Errorf("unexpected transaction to 0x%x: %x", addr, w)
+	}
+	reg := int(binary.BigEndian.Uint16(w))
+	copy(c.mem[reg:], w[2:])
+	if reg == int(regCommandID) && len(w) == 4 {
+		c.command(binary.BigEndian.Uint16(w[2:]))
+	}
+	copy(r, c.mem[reg:])
+	return nil
+}
+
+// command executes a command written to the command register.
+func (c *fakeCCI) command(cmd uint16) {
+	id := cmd &^ (cciTypeSet | cciTypeRun)
+	c.executed[id]++
+	status := statusBootMask
+	size := 2 * int(binary.BigEndian.Uint16(c.mem[regDataLength:]))
+	if code, ok := c.errs[id]; ok {
+		status |= uint16(uint8(code)) << 8
+	} else if cmd&cciTypeRun == cciTypeRun {
+	} else if cmd&cciTypeSet == cciTypeSet {
+		c.attrs[id] = append([]byte(nil), c.mem[regData0:int(regData0)+size]...)
+	} else {
+		val := c.attrs[id]
+		for i := 0; i < size; i++ {
+			c.mem[int(regData0)+i] = 0
+		}
+		copy(c.mem[regData0:int(regData0)+size], val)
+	}
+	binary.BigEndian.PutUint16(c.mem[regStatus:], status)
+}
+
+// count returns the number of times cmd has been executed.
+func (c *fakeCCI) count(cmd cciCommand) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.executed[cmd.id]
+}
+
+// setAttr sets the value returned by GET commands for cmd, as the
+// 16-bit words given.
+func (c *fakeCCI) setAttr(cmd cciCommand, words ...uint16) {
+	val := make([]byte, 2*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint16(val[2*i:], w)
+	}
+	c.mu.Lock()
+	c.attrs[cmd.id] = val
+	c.mu.Unlock()
+}
+
+const testSPISpeed = 30000000
+
+var fakeDevices int32
+
+// newTestCamera returns a Lepton3 which talks to spiConn and cciBus
+// (a new fakeCCI if nil) instead of hardware. The returned function
+// closes the camera and removes the fake devices.
+func newTestCamera(t testing.TB, spiConn *fakeSPI, cciBus *fakeCCI) (*Lepton3, func()) {
+	t.Helper()
+	if cciBus == nil {
+		cciBus = newFakeCCI()
+	}
+	n := atomic.AddInt32(&fakeDevices, 1)
+	spiName := fmt.Sprintf("fakespi%d", n)
+	i2cName := fmt.Sprintf("fakei2c%d", n)
+	err := spireg.Register(spiName, nil, -1, func() (spi.PortCloser, error) {
+		return fakeSPIPort{spiConn}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i2creg.Register(i2cName, nil, -1, func() (i2c.BusCloser, error) {
+		return cciBus, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithDevices(testSPISpeed, spiName, i2cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		spireg.Unregister(spiName)
+		i2creg.Unregister(i2cName)
+	}
+}
+
+// testFrame returns the packets of a complete frame for layout. The
+// payload of every packet of segment n is filled with fill+n-1.
+func testFrame(layout TelemetryLayout, fill byte) [][]byte {
+	var packets [][]byte
+	for seg := 1; seg <= segmentsPerFrame; seg++ {
+		packets = append(packets, testSegment(layout, seg, fill+byte(seg-1))...)
+	}
+	return packets
+}
+
+// testLog collects the messages logged by a Lepton3 (see
+// SetLogFunc).
+type testLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLog) log(msg string) {
+	l.mu.Lock()
+	l.lines = append(l.lines, msg)
+	l.mu.Unlock()
+}
+
+// count returns the number of messages containing substr.
+func (l *testLog) count(substr string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			n++
+		}
+	}
+	return n
+}
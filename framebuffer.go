@@ -0,0 +1,75 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// PixelFormat is the pixel layout of a framebuffer written by
+// ColorizeFramebuffer.
+type PixelFormat int
+
+const (
+	// PixelRGB565 is 16 bits per pixel with 5 bits red, 6 bits green
+	// and 5 bits blue, stored little endian.
+	PixelRGB565 PixelFormat = iota
+
+	// PixelBGRA8888 is 32 bits per pixel, stored as blue, green, red
+	// and alpha bytes.
+	PixelBGRA8888
+)
+
+// BytesPerPixel returns the size of a pixel in the format, or 0 if the
+// format isn't valid.
+func (f PixelFormat) BytesPerPixel() int {
+	switch f {
+	case PixelRGB565:
+		return 2
+	case PixelBGRA8888:
+		return 4
+	}
+	return 0
+}
+
+// ColorizeFramebuffer is like ColorizeInto but writes the false colour
+// version of src straight into dst in the given pixel format, ready to
+// be written to a framebuffer device such as /dev/fb0. Rows are packed
+// with no padding, so dst must be exactly width*height*BytesPerPixel
+// bytes.
+func ColorizeFramebuffer(src *image.Gray16, agc AGC, dst []byte, format PixelFormat, palette Palette) error {
+	bpp := format.BytesPerPixel()
+	if bpp == 0 {
+		return fmt.Errorf("invalid pixel format: %d", format)
+	}
+	b := src.Bounds()
+	if size := b.Dx() * b.Dy() * bpp; len(dst) != size {
+		return fmt.Errorf("framebuffer must be %d bytes, got %d", size, len(dst))
+	}
+	if len(palette) != 256 {
+		return fmt.Errorf("palette must have 256 entries, got %d", len(palette))
+	}
+
+	stride := b.Dx() * bpp
+	agcInPlace(src, agc, dst, stride)
+	for row := dst; len(row) > 0; row = row[stride:] {
+		for x := b.Dx() - 1; x >= 0; x-- {
+			c := palette[row[x]]
+			j := x * bpp
+			if format == PixelRGB565 {
+				binary.LittleEndian.PutUint16(row[j:],
+					uint16(c.R>>3)<<11|uint16(c.G>>2)<<5|uint16(c.B>>3))
+			} else {
+				row[j] = c.B
+				row[j+1] = c.G
+				row[j+2] = c.R
+				row[j+3] = c.A
+			}
+		}
+	}
+	return nil
+}
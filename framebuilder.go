@@ -5,56 +5,283 @@
 package lepton3
 
 import (
+	"bytes"
 	"fmt"
+	"math/bits"
 )
 
 func newFrameBuilder() *frameBuilder {
 	f := &frameBuilder{
 		segmentBuf: make([]byte, packetsPerSegment*vospiDataSize),
 		frameBuf:   make([]byte, packetsPerFrame*vospiDataSize),
+		segments:   segmentsPerFrame,
 	}
+	f.setTelemetryLayout(TelemetryHeader)
 	f.reset()
 	return f
 }
 
+// TelemetryLayout describes where (if anywhere) the camera includes
+// telemetry in the video stream. This changes the number of packets
+// per segment so it must match the camera's configuration.
+type TelemetryLayout int
+
+const (
+	// TelemetryHeader means telemetry is sent as 4 extra packets at
+	// the start of each frame, making each segment 61 packets
+	// long. This is how New configures the camera.
+	TelemetryHeader TelemetryLayout = iota
+
+	// TelemetryDisabled means no telemetry is sent and each segment
+	// is 60 packets long. The telemetry portion of raw frames is
+	// zeroed.
+	TelemetryDisabled
+
+	// TelemetryFooter means telemetry is sent as 4 extra packets at
+	// the end of each frame, making each segment 61 packets long.
+	// Raw frames still have the telemetry at the start so that the
+	// pixels are always in the same place.
+	TelemetryFooter
+)
+
+// enabled returns true if the layout includes telemetry packets.
+func (l TelemetryLayout) enabled() bool {
+	return l != TelemetryDisabled
+}
+
+// TelemetryLayoutError is returned by NextFrame when the packets
+// received don't match the expected TelemetryLayout.
+type TelemetryLayoutError struct {
+	Expected TelemetryLayout
+}
+
+func (e *TelemetryLayoutError) Error() string {
+	if e.Expected.enabled() {
+		return "telemetry layout mismatch: expected telemetry but segments have no telemetry packets"
+	}
+	return "telemetry layout mismatch: expected no telemetry but segments include telemetry packets"
+}
+
+// Number of consecutive short segments which indicate that the camera
+// isn't sending telemetry, rather than a packet having been lost. The
+// same number of consecutive long segments indicate that it is.
+const shortSegmentLimit = 2
+
+// SegmentZeroPolicy controls how frame assembly treats segments
+// numbered 0. The camera uses segment number 0 to flag a segment which
+// isn't part of a valid frame, for example while it is starting up.
+// Such segments are never treated as errors.
+type SegmentZeroPolicy int
+
+const (
+	// SegmentZeroRestart discards any partially assembled frame
+	// when a segment 0 is seen, so assembly restarts with the next
+	// segment 1. This is the default.
+	SegmentZeroRestart SegmentZeroPolicy = iota
+
+	// SegmentZeroSkip ignores segments numbered 0 but keeps any
+	// partially assembled frame, so assembly continues if the next
+	// valid segment is the one expected.
+	SegmentZeroSkip
+)
+
+// SegmentRepeatPolicy controls how frame assembly treats a segment
+// with the same number as the one just received. Some cameras resend
+// a segment (e.g. after a VoSPI timing glitch) rather than moving on
+// to the next.
+type SegmentRepeatPolicy int
+
+const (
+	// SegmentRepeatReplace treats a repeated segment as a retry: it
+	// replaces the earlier copy and assembly continues with the next
+	// segment. This is the default.
+	SegmentRepeatReplace SegmentRepeatPolicy = iota
+
+	// SegmentRepeatRestart treats a repeated segment like any other
+	// out of order segment, discarding the partially assembled
+	// frame.
+	SegmentRepeatRestart
+)
+
+// AssemblyMode selects how packets are assembled into segments.
+type AssemblyMode int
+
+const (
+	// AssemblySequential requires the packets of each segment to
+	// arrive strictly in order. A packet out of sequence is an
+	// error, which causes a resync. This is the default.
+	AssemblySequential AssemblyMode = iota
+
+	// AssemblyTracked stores each packet at the position given by
+	// its packet number and tracks which of a segment's packets have
+	// arrived, so packets reordered within a segment are tolerated.
+	// A segment is complete once all its packets have arrived. A
+	// packet identical to one already received is a duplicate and
+	// is ignored. Otherwise a packet number repeating before the
+	// segment is complete means the next segment has started and
+	// data was genuinely lost, which is handled like a lost
+	// segment. This suits setups which would otherwise be stuck in a
+	// resync loop.
+	AssemblyTracked
+)
+
+// WarmupPolicy controls what NextFrame does while the camera is
+// warming up, which it indicates by sending only segments numbered 0
+// for a while after starting.
+type WarmupPolicy int
+
+const (
+	// WarmupWait means NextFrame silently waits for the camera to
+	// become ready, subject to the usual frame timeout. This is the
+	// default.
+	WarmupWait WarmupPolicy = iota
+
+	// WarmupReport means NextFrame returns ErrWarmingUp when the
+	// camera is warming up, so that callers can show an appropriate
+	// status. Calling NextFrame again continues waiting.
+	WarmupReport
+)
+
+// Number of frames' worth of consecutive segments numbered 0 after
+// which the camera is considered to be warming up. During normal
+// operation the camera sends 2 frames' worth of segment 0 between
+// valid frames.
+const warmupFrames = 3
+
 type frameBuilder struct {
-	segmentBuf []byte
-	frameBuf   []byte
-	packetNum  int
-	segmentNum int
+	segmentBuf  []byte
+	frameBuf    []byte
+	packetNum   int
+	segmentNum  int
+	skipSegment bool
+	segmentZero SegmentZeroPolicy
+	repeat      SegmentRepeatPolicy
+	mode        AssemblyMode
+	strict      bool
+
+	// Number of segments which make up a frame. Single segment
+	// frames don't carry a segment number.
+	segments int
+
+	// endOfSegment is set when the last packet processed ended a
+	// segment.
+	endOfSegment bool
+
+	// Packets received in the current segment (AssemblyTracked).
+	received      uint64
+	allReceived   uint64
+	trackedSegNum int
+
+	telemetry     TelemetryLayout
+	lastPacket    int
+	shortSegments int
+
+	// Consecutive segments with a packet beyond lastPacket, and
+	// whether the current segment has had one.
+	longSegments int
+	longSegment  bool
+
+	outOfOrderSegments int
+	zeroSegments       int
+}
+
+func (f *frameBuilder) setTelemetryLayout(layout TelemetryLayout) {
+	f.telemetry = layout
+	f.lastPacket = maxPacketNum
+	if layout == TelemetryDisabled {
+		f.lastPacket = maxPacketNum - 1
+	}
+	f.segmentBuf = f.segmentBuf[:(f.lastPacket+1)*vospiDataSize]
+	f.shortSegments = 0
+	f.longSegments = 0
+	f.longSegment = false
+	f.allReceived = 1<<uint(f.lastPacket+1) - 1
+	f.received = 0
+}
+
+// framePackets returns the number of packets which make up a frame.
+func (f *frameBuilder) framePackets() int {
+	return f.segments * (f.lastPacket + 1)
+}
+
+// setSegments sets the number of segments per frame, from 1 up to
+// segmentsPerFrame.
+func (f *frameBuilder) setSegments(n int) error {
+	if n < 1 || n > segmentsPerFrame {
+		return fmt.Errorf("invalid number of segments per frame: %d", n)
+	}
+	f.segments = n
+	f.reset()
+	return nil
+}
+
+// segmentNumber returns the segment number carried by packet, which
+// must be packet segmentPacketNum.
+func (f *frameBuilder) segmentNumber(packet []byte) int {
+	if f.segments == 1 {
+		return 1
+	}
+	return int(packet[0] >> 4)
 }
 
 func (f *frameBuilder) reset() {
 	f.frameBuf = f.frameBuf[:0]
 	f.packetNum = -1
 	f.segmentNum = 0
+	f.skipSegment = false
+	f.outOfOrderSegments = 0
+	f.zeroSegments = 0
+	f.endOfSegment = false
+	f.received = 0
+	f.trackedSegNum = 0
 }
 
 func (f *frameBuilder) nextPacket(packetNum int, packet []byte) (bool, error) {
+	if packetNum > f.lastPacket {
+		return false, f.longPacket(packetNum)
+	}
+	if packetNum == 0 {
+		if !f.longSegment {
+			f.longSegments = 0
+		}
+		f.longSegment = false
+		// Not known until the segment number arrives.
+		f.skipSegment = false
+	}
+	f.endOfSegment = false
+	if f.mode == AssemblyTracked {
+		return f.nextTrackedPacket(packetNum, packet)
+	}
+	if f.telemetry.enabled() && packetNum == 0 && f.packetNum == f.lastPacket-1 {
+		// A segment ended one packet short. Once is probably a
+		// lost packet, but repeatedly means there's no telemetry.
+		f.shortSegments++
+		if f.shortSegments >= shortSegmentLimit {
+			return false, &TelemetryLayoutError{Expected: f.telemetry}
+		}
+	} else if packetNum == f.lastPacket {
+		f.shortSegments = 0
+	}
+
 	if !f.sequential(packetNum) {
 		return false, fmt.Errorf("out of order packet: %d -> %d", f.packetNum, packetNum)
 	}
 
+	if f.strict {
+		f.assert(packetNum >= 0 && packetNum <= f.lastPacket, "packet number %d out of range", packetNum)
+		f.assert(len(packet) == vospiPacketSize, "packet length %d", len(packet))
+	}
 	copy(f.segmentBuf[packetNum*vospiDataSize:], packet[vospiHeaderSize:])
 
 	switch packetNum {
 	case segmentPacketNum:
 		// This is the packet that has the segment number set.
-		segmentNum := int(packet[0] >> 4)
-		if segmentNum > 4 {
-			return false, fmt.Errorf("invalid segment number: %d", segmentNum)
+		if err := f.startSegment(f.segmentNumber(packet)); err != nil {
+			return false, err
 		}
-		if segmentNum > 0 && segmentNum != f.segmentNum+1 {
-			// TODO this might not warrant a resync but certainly ignoring of the segment
-			return false, fmt.Errorf("out of order segment")
-		}
-		f.segmentNum = segmentNum
-	case maxPacketNum:
-		// End of segment.
-		if f.segmentNum > 0 {
-			f.frameBuf = append(f.frameBuf, f.segmentBuf...)
-		}
-		if f.segmentNum == 4 {
+	case f.lastPacket:
+		f.endOfSegment = true
+		if f.endSegment() {
 			// Complete frame!
 			return true, nil
 		}
@@ -63,13 +290,249 @@ func (f *frameBuilder) nextPacket(packetNum int, packet []byte) (bool, error) {
 	return false, nil
 }
 
+// longPacket handles a packet numbered beyond the end of a segment,
+// which is only possible when telemetry is disabled. If every segment
+// has one the camera is sending telemetry, otherwise the packet is
+// corrupt and an error is returned so that it is treated as a bad
+// packet.
+func (f *frameBuilder) longPacket(packetNum int) error {
+	if !f.longSegment {
+		f.longSegment = true
+		f.longSegments++
+	}
+	if f.longSegments >= shortSegmentLimit {
+		return &TelemetryLayoutError{Expected: f.telemetry}
+	}
+	return fmt.Errorf("packet number %d beyond end of segment", packetNum)
+}
+
+// nextTrackedPacket implements nextPacket for AssemblyTracked.
+func (f *frameBuilder) nextTrackedPacket(packetNum int, packet []byte) (bool, error) {
+	if f.strict {
+		f.assert(len(packet) == vospiPacketSize, "packet length %d", len(packet))
+	}
+	bit := uint64(1) << uint(packetNum)
+	if f.received&bit != 0 {
+		if f.duplicatePacket(packetNum, packet) {
+			return false, nil
+		}
+		// The next segment has started before this one was
+		// complete.
+		if err := f.dropTrackedSegment(); err != nil {
+			return false, err
+		}
+	}
+	copy(f.segmentBuf[packetNum*vospiDataSize:], packet[vospiHeaderSize:])
+	f.received |= bit
+	f.packetNum = packetNum
+	if packetNum == segmentPacketNum {
+		f.trackedSegNum = f.segmentNumber(packet)
+	}
+	if f.received != f.allReceived {
+		return false, nil
+	}
+
+	f.received = 0
+	f.shortSegments = 0
+	f.endOfSegment = true
+	if err := f.startSegment(f.trackedSegNum); err != nil {
+		return false, err
+	}
+	return f.endSegment(), nil
+}
+
+// duplicatePacket returns true if packet is identical to the copy of
+// it already received for the current segment (AssemblyTracked).
+func (f *frameBuilder) duplicatePacket(packetNum int, packet []byte) bool {
+	if packetNum == segmentPacketNum && f.segmentNumber(packet) != f.trackedSegNum {
+		return false
+	}
+	offset := packetNum * vospiDataSize
+	return bytes.Equal(f.segmentBuf[offset:offset+vospiDataSize], packet[vospiHeaderSize:])
+}
+
+// dropTrackedSegment discards an incomplete segment in AssemblyTracked
+// mode. As with a lost segment, the partial frame is discarded unless
+// this keeps happening.
+func (f *frameBuilder) dropTrackedSegment() error {
+	missing := f.allReceived &^ f.received
+	f.received = 0
+	if f.telemetry.enabled() && missing == 1<<uint(f.lastPacket) {
+		// Only the last packet is missing. Repeatedly means
+		// there's no telemetry.
+		f.shortSegments++
+		if f.shortSegments >= shortSegmentLimit {
+			return &TelemetryLayoutError{Expected: f.telemetry}
+		}
+	}
+	f.outOfOrderSegments++
+	if f.outOfOrderSegments > f.outOfOrderLimit() {
+		return fmt.Errorf("incomplete segment: %d packets missing", bits.OnesCount64(missing))
+	}
+	f.frameBuf = f.frameBuf[:0]
+	f.segmentNum = 0
+	return nil
+}
+
+// startSegment checks the number of a segment against the one
+// expected, setting skipSegment if it shouldn't be added to the frame.
+func (f *frameBuilder) startSegment(segmentNum int) error {
+	if segmentNum > f.segments {
+		return fmt.Errorf("invalid segment number: %d", segmentNum)
+	}
+	if segmentNum == 0 {
+		// The camera isn't ready or the segment isn't part of
+		// a valid frame.
+		f.zeroSegments++
+		f.skipSegment = true
+		if f.segmentZero == SegmentZeroRestart {
+			f.frameBuf = f.frameBuf[:0]
+			f.segmentNum = 0
+		}
+	} else if segmentNum == f.segmentNum && f.repeat == SegmentRepeatReplace {
+		// The camera is resending the last segment. Drop the
+		// earlier copy so this one takes its place.
+		if len(f.frameBuf) == segmentNum*len(f.segmentBuf) {
+			f.frameBuf = f.frameBuf[:len(f.frameBuf)-len(f.segmentBuf)]
+		}
+		f.skipSegment = false
+		f.zeroSegments = 0
+	} else if segmentNum != f.segmentNum+1 && segmentNum != 1 {
+		// Usually a segment was lost. Discard the partial frame
+		// and restart assembly at the next segment 1 rather than
+		// resyncing, unless this keeps happening.
+		f.outOfOrderSegments++
+		if f.outOfOrderSegments > f.outOfOrderLimit() {
+			return fmt.Errorf("out of order segment: %d -> %d", f.segmentNum, segmentNum)
+		}
+		f.skipSegment = true
+		f.frameBuf = f.frameBuf[:0]
+		f.segmentNum = 0
+	} else {
+		if segmentNum == 1 {
+			// A new frame always starts here, even if the
+			// previous one wasn't completed.
+			f.frameBuf = f.frameBuf[:0]
+		}
+		f.skipSegment = false
+		f.segmentNum = segmentNum
+		f.outOfOrderSegments = 0
+		f.zeroSegments = 0
+	}
+	return nil
+}
+
+// endSegment adds the segment just received to the frame unless it is
+// being skipped. It returns true if the frame is complete.
+func (f *frameBuilder) endSegment() bool {
+	if f.skipSegment {
+		return false
+	}
+	if f.segmentNum > 0 {
+		if f.strict {
+			f.assert(len(f.frameBuf) == (f.segmentNum-1)*len(f.segmentBuf),
+				"frame has %d bytes at end of segment %d", len(f.frameBuf), f.segmentNum)
+		}
+		f.frameBuf = append(f.frameBuf, f.segmentBuf...)
+	}
+	return f.segmentNum == f.segments
+}
+
+// currentSegment returns the number of the segment currently being
+// assembled, or 0 if it isn't known.
+func (f *frameBuilder) currentSegment() int {
+	if f.packetNum < 0 {
+		return 0
+	}
+	if f.packetNum >= segmentPacketNum && f.packetNum < f.lastPacket {
+		// The segment number has been seen.
+		if f.skipSegment {
+			return 0
+		}
+		return f.segmentNum
+	}
+	if f.segmentNum >= f.segments {
+		return 0
+	}
+	return f.segmentNum + 1
+}
+
+// warmingUp returns true if the camera has only sent segments
+// numbered 0 for long enough that it isn't ready yet.
+func (f *frameBuilder) warmingUp() bool {
+	return f.zeroSegments >= warmupFrames*f.segments
+}
+
+// outOfOrderLimit returns the number of consecutive out of order
+// segments tolerated before resyncing. After a lost segment, the rest
+// of the segments in the frame are out of order until the next frame
+// starts.
+func (f *frameBuilder) outOfOrderLimit() int {
+	return f.segments
+}
+
 func (f *frameBuilder) sequential(packetNum int) bool {
-	if packetNum == 0 && f.packetNum == maxPacketNum {
+	if packetNum == 0 && f.packetNum == f.lastPacket {
 		return true
 	}
 	return packetNum == f.packetNum+1
 }
 
+// output writes the assembled frame to outFrame. Each video packet
+// holds half an image row (colsPerPacket pixels): even numbered image
+// packets are the left half of a row and odd ones the right half.
+// Packet payloads are concatenated in order, so this mapping falls out
+// of the copy with no column adjustment.
 func (f *frameBuilder) output(outFrame []byte) {
-	copy(outFrame, f.frameBuf)
+	if f.strict {
+		f.assert(len(f.frameBuf) == f.segments*len(f.segmentBuf), "complete frame has %d bytes", len(f.frameBuf))
+		f.assert(len(outFrame) >= BytesPerFrame, "output frame has %d bytes", len(outFrame))
+	}
+	// Keep the raw frame layout the same regardless of telemetry so
+	// the pixels are always in the same place.
+	switch f.telemetry {
+	case TelemetryDisabled:
+		for i := range outFrame[:telemetryBytes] {
+			outFrame[i] = 0
+		}
+		copy(outFrame[telemetryBytes:], f.frameBuf)
+	case TelemetryFooter:
+		pixelBytes := len(f.frameBuf) - telemetryBytes
+		copy(outFrame, f.frameBuf[pixelBytes:])
+		copy(outFrame[telemetryBytes:], f.frameBuf[:pixelBytes])
+	default:
+		copy(outFrame, f.frameBuf)
+	}
+}
+
+// telemetryData returns the telemetry of a complete frame, before it
+// has been output. It returns nil if telemetry is disabled.
+func (f *frameBuilder) telemetryData() []byte {
+	switch f.telemetry {
+	case TelemetryHeader:
+		return f.frameBuf[:telemetryBytes]
+	case TelemetryFooter:
+		return f.frameBuf[len(f.frameBuf)-telemetryBytes:]
+	}
+	return nil
+}
+
+// pixelData returns the pixels of a complete frame, before it has been
+// output.
+func (f *frameBuilder) pixelData() []byte {
+	switch f.telemetry {
+	case TelemetryHeader:
+		return f.frameBuf[telemetryBytes:]
+	case TelemetryFooter:
+		return f.frameBuf[:len(f.frameBuf)-telemetryBytes]
+	}
+	return f.frameBuf
+}
+
+// assert panics if cond is false. It is only used when strict mode is
+// enabled, to catch internal invariant violations during development.
+func (f *frameBuilder) assert(cond bool, format string, args ...interface{}) {
+	if !cond {
+		panic("lepton3: invariant violated: " + fmt.Sprintf(format, args...))
+	}
 }
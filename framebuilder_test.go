@@ -0,0 +1,613 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testPacket returns a VoSPI packet with a valid CRC. segmentNum is
+// only encoded in packet segmentPacketNum and every payload byte is
+// set to fill. Packet 0 filled with 0 has a zero CRC, which is
+// discarded unless zero CRC discarding is disabled.
+func testPacket(packetNum, segmentNum int, fill byte) []byte {
+	packet := make([]byte, vospiPacketSize)
+	binary.BigEndian.PutUint16(packet, uint16(packetNum))
+	if packetNum == segmentPacketNum {
+		packet[0] |= byte(segmentNum << 4)
+	}
+	for i := vospiHeaderSize; i < len(packet); i++ {
+		packet[i] = fill
+	}
+	binary.BigEndian.PutUint16(packet[2:], packetCRC(packet))
+	return packet
+}
+
+// testSegment returns the packets of a complete segment for layout,
+// with payloads filled with fill.
+func testSegment(layout TelemetryLayout, segmentNum int, fill byte) [][]byte {
+	n := packetsPerSegment
+	if !layout.enabled() {
+		n--
+	}
+	packets := make([][]byte, n)
+	for i := range packets {
+		packets[i] = testPacket(i, segmentNum, fill)
+	}
+	return packets
+}
+
+// feedPackets passes packets to f, failing the test if a frame
+// completes before the last packet. It returns the result for the
+// last packet, or the first error.
+func feedPackets(t *testing.T, f *frameBuilder, packets [][]byte) (bool, error) {
+	t.Helper()
+	for i, packet := range packets {
+		num := int(binary.BigEndian.Uint16(packet) & packetNumMask)
+		complete, err := f.nextPacket(num, packet)
+		if err != nil {
+			return false, err
+		}
+		if complete && i != len(packets)-1 {
+			t.Fatalf("frame completed early at packet %d of %d", i, len(packets))
+		}
+		if i == len(packets)-1 {
+			return complete, nil
+		}
+	}
+	return false, nil
+}
+
+// concatPackets joins groups of packets into one stream.
+func concatPackets(groups ...[][]byte) [][]byte {
+	var out [][]byte
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+func TestFrameBuilderSegmentsPerFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments int
+		stream   [][]byte
+	}{
+		{
+			name:     "1 segment",
+			segments: 1,
+			// Single segment cameras don't send a segment number.
+			stream: testSegment(TelemetryHeader, 0, 1),
+		},
+		{
+			name:     "4 segments",
+			segments: 4,
+			stream: concatPackets(
+				testSegment(TelemetryHeader, 1, 1),
+				testSegment(TelemetryHeader, 2, 2),
+				testSegment(TelemetryHeader, 3, 3),
+				testSegment(TelemetryHeader, 4, 4),
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFrameBuilder()
+			f.strict = true
+			if err := f.setSegments(tt.segments); err != nil {
+				t.Fatal(err)
+			}
+			complete, err := feedPackets(t, f, tt.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !complete {
+				t.Fatal("frame not complete")
+			}
+			segmentBytes := packetsPerSegment * vospiDataSize
+			if len(f.frameBuf) != tt.segments*segmentBytes {
+				t.Fatalf("frame has %d bytes, want %d", len(f.frameBuf), tt.segments*segmentBytes)
+			}
+			for seg := 0; seg < tt.segments; seg++ {
+				if got := f.frameBuf[seg*segmentBytes]; got != byte(seg+1) {
+					t.Errorf("segment %d starts with %d", seg+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameBuilderSegmentsPerFrameRange(t *testing.T) {
+	f := newFrameBuilder()
+	for _, n := range []int{0, segmentsPerFrame + 1} {
+		if err := f.setSegments(n); err == nil {
+			t.Errorf("%d segments accepted", n)
+		}
+	}
+}
+
+func TestFrameBuilderSegmentNumberBeyondFrame(t *testing.T) {
+	f := newFrameBuilder()
+	if err := f.setSegments(2); err != nil {
+		t.Fatal(err)
+	}
+	stream := concatPackets(testSegment(TelemetryHeader, 1, 1), testSegment(TelemetryHeader, 3, 3))
+	if _, err := feedPackets(t, f, stream); err == nil {
+		t.Error("expected an error for segment 3 of a 2 segment frame")
+	}
+}
+
+func TestFrameBuilderSegmentLimits(t *testing.T) {
+	for _, segments := range []int{2, segmentsPerFrame} {
+		f := newFrameBuilder()
+		if err := f.setSegments(segments); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= warmupFrames*segments; i++ {
+			if _, err := feedPackets(t, f, testSegment(TelemetryHeader, 0, 0xa5)); err != nil {
+				t.Fatal(err)
+			}
+			if want := i == warmupFrames*segments; f.warmingUp() != want {
+				t.Errorf("%d segments: warming up after %d segment 0s = %v, want %v",
+					segments, i, f.warmingUp(), want)
+			}
+		}
+
+		// Segment 2 without a segment 1 is out of order. One more
+		// than the number of segments per frame causes a resync.
+		f.reset()
+		var err error
+		for i := 0; i <= segments && err == nil; i++ {
+			_, err = feedPackets(t, f, testSegment(TelemetryHeader, 2, 2))
+			if i < segments && err != nil {
+				t.Errorf("%d segments: error after %d out of order segments: %v", segments, i+1, err)
+			}
+		}
+		if err == nil {
+			t.Errorf("%d segments: out of order segments not limited", segments)
+		}
+	}
+}
+
+func TestDecoderSingleSegment(t *testing.T) {
+	d := NewDecoder()
+	d.CheckCRC = true
+	if err := d.SetSegmentsPerFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	raw := NewRawFrame()
+	for frame := 1; frame <= 2; frame++ {
+		var complete bool
+		for _, packet := range testSegment(TelemetryHeader, 0, byte(frame)) {
+			var err error
+			if complete, err = d.Decode(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !complete {
+			t.Fatalf("frame %d not complete", frame)
+		}
+		if _, err := d.Segment(2); err == nil {
+			t.Error("segment 2 of a 1 segment frame accepted")
+		}
+		d.Frame(raw)
+		if raw[0] != byte(frame) {
+			t.Errorf("frame %d starts with %d", frame, raw[0])
+		}
+	}
+}
+
+// withoutPacket returns a copy of a segment's packets with packet num
+// removed.
+func withoutPacket(packets [][]byte, num int) [][]byte {
+	out := append([][]byte(nil), packets[:num]...)
+	return append(out, packets[num+1:]...)
+}
+
+// swapPackets returns a copy of packets with packets i and j swapped.
+func swapPackets(packets [][]byte, i, j int) [][]byte {
+	out := append([][]byte(nil), packets...)
+	out[i], out[j] = out[j], out[i]
+	return out
+}
+
+// duplicatePacket returns a copy of packets with packet num sent
+// twice.
+func duplicatePacket(packets [][]byte, num int) [][]byte {
+	out := append([][]byte(nil), packets[:num+1]...)
+	return append(out, packets[num:]...)
+}
+
+// testFrameWith returns the packets of a complete frame (see
+// testFrame) after applying edit to the packets of each segment.
+func testFrameWith(layout TelemetryLayout, fill byte, edit func(seg int, packets [][]byte) [][]byte) [][]byte {
+	var packets [][]byte
+	for seg := 1; seg <= segmentsPerFrame; seg++ {
+		packets = append(packets, edit(seg, testSegment(layout, seg, fill+byte(seg-1)))...)
+	}
+	return packets
+}
+
+func TestFrameBuilderTracked(t *testing.T) {
+	isLayoutErr := func(err error) bool {
+		_, ok := err.(*TelemetryLayoutError)
+		return ok
+	}
+	isIncomplete := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "incomplete segment")
+	}
+
+	tests := []struct {
+		name     string
+		stream   [][]byte
+		complete bool
+		fill     byte             // of segment 1 of the frame output
+		errCheck func(error) bool // nil means no error is expected
+	}{
+		{
+			name:   "in order",
+			stream: testFrame(TelemetryHeader, 1),
+			fill:   1,
+		},
+		{
+			name: "reordered",
+			stream: testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+				// Includes the segment number packet and the
+				// last packet.
+				p = swapPackets(p, 5, 6)
+				p = swapPackets(p, segmentPacketNum, segmentPacketNum+2)
+				return swapPackets(p, maxPacketNum-1, maxPacketNum)
+			}),
+			fill: 1,
+		},
+		{
+			name: "duplicated",
+			stream: testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+				p = duplicatePacket(p, 0)
+				return duplicatePacket(p, segmentPacketNum+1)
+			}),
+			fill: 1,
+		},
+		{
+			name: "missing packet discards the frame",
+			stream: concatPackets(
+				testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+					if seg == 2 {
+						return withoutPacket(p, 30)
+					}
+					return p
+				}),
+				testFrame(TelemetryHeader, 11),
+			),
+			fill: 11,
+		},
+		{
+			name: "packets keep going missing",
+			stream: concatPackets(
+				testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+					return withoutPacket(p, 30)
+				}),
+				testFrameWith(TelemetryHeader, 11, func(seg int, p [][]byte) [][]byte {
+					return withoutPacket(p, 30)
+				}),
+			),
+			errCheck: isIncomplete,
+		},
+		{
+			name: "no telemetry",
+			stream: testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+				return withoutPacket(p, maxPacketNum)
+			}),
+			errCheck: isLayoutErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFrameBuilder()
+			f.strict = true
+			f.mode = AssemblyTracked
+			complete, err := feedPackets(t, f, tt.stream)
+			if tt.errCheck != nil {
+				if !tt.errCheck(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !complete {
+				t.Fatal("frame not complete")
+			}
+			raw := NewRawFrame()
+			f.output(raw)
+			for seg := 0; seg < segmentsPerFrame; seg++ {
+				want := tt.fill + byte(seg)
+				offset := seg * packetsPerSegment * vospiDataSize
+				for i, b := range raw[offset : offset+packetsPerSegment*vospiDataSize] {
+					if b != want {
+						t.Fatalf("segment %d byte %d = %d, want %d", seg+1, i, b, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFrameBuilderSegmentZeroPolicy(t *testing.T) {
+	seg := func(n int, fill byte) [][]byte {
+		return testSegment(TelemetryHeader, n, fill)
+	}
+	tests := []struct {
+		name   string
+		stream [][]byte
+		// First byte of each segment of the output for each
+		// policy, or nil if no frame should be completed.
+		restart []byte
+		skip    []byte
+	}{
+		{
+			name:    "before frame",
+			stream:  concatPackets(seg(0, 9), seg(0, 9), seg(1, 1), seg(2, 2), seg(3, 3), seg(4, 4)),
+			restart: []byte{1, 2, 3, 4},
+			skip:    []byte{1, 2, 3, 4},
+		},
+		{
+			name:    "mid frame",
+			stream:  concatPackets(seg(1, 1), seg(2, 2), seg(0, 9), seg(3, 3), seg(4, 4)),
+			restart: nil,
+			skip:    []byte{1, 2, 3, 4},
+		},
+		{
+			name: "mid frame then next frame",
+			stream: concatPackets(seg(1, 1), seg(2, 2), seg(0, 9),
+				seg(1, 5), seg(2, 6), seg(3, 7), seg(4, 8)),
+			// With SegmentZeroSkip the partial frame is kept
+			// until the next segment 1 replaces it.
+			restart: []byte{5, 6, 7, 8},
+			skip:    []byte{5, 6, 7, 8},
+		},
+		{
+			name: "lost segments then next frame",
+			stream: concatPackets(seg(1, 1), seg(2, 2),
+				seg(1, 5), seg(2, 6), seg(3, 7), seg(4, 8)),
+			restart: []byte{5, 6, 7, 8},
+			skip:    []byte{5, 6, 7, 8},
+		},
+	}
+	for _, tt := range tests {
+		for _, policy := range []SegmentZeroPolicy{SegmentZeroRestart, SegmentZeroSkip} {
+			want := tt.restart
+			if policy == SegmentZeroSkip {
+				want = tt.skip
+			}
+			f := newFrameBuilder()
+			f.strict = true
+			f.segmentZero = policy
+			var complete bool
+			for _, packet := range tt.stream {
+				num := int(binary.BigEndian.Uint16(packet) & packetNumMask)
+				var err error
+				if complete, err = f.nextPacket(num, packet); err != nil {
+					t.Fatalf("%s (policy %d): %v", tt.name, policy, err)
+				}
+				if complete {
+					break
+				}
+			}
+			if complete != (want != nil) {
+				t.Errorf("%s (policy %d): complete = %v, want %v", tt.name, policy, complete, want != nil)
+				continue
+			}
+			for i, fill := range want {
+				if got := f.frameBuf[i*packetsPerSegment*vospiDataSize]; got != fill {
+					t.Errorf("%s (policy %d): segment %d = %d, want %d", tt.name, policy, i+1, got, fill)
+				}
+			}
+		}
+	}
+}
+
+// feedWithResync passes packets to f, resetting it after errors other
+// than a TelemetryLayoutError as NextFrame would. It returns the
+// number of frames completed, the number of other errors and any
+// TelemetryLayoutError.
+func feedWithResync(f *frameBuilder, packets [][]byte) (frames, badPackets int, layoutErr error) {
+	for _, packet := range packets {
+		num := int(binary.BigEndian.Uint16(packet) & packetNumMask)
+		complete, err := f.nextPacket(num, packet)
+		if _, ok := err.(*TelemetryLayoutError); ok {
+			return frames, badPackets, err
+		} else if err != nil {
+			badPackets++
+			f.reset()
+		} else if complete {
+			frames++
+			f.reset()
+		}
+	}
+	return frames, badPackets, nil
+}
+
+func TestFrameBuilderTelemetryMismatch(t *testing.T) {
+	// A frame without telemetry where packet 30 of segment 2 has its
+	// number corrupted to 60.
+	corrupt := testFrameWith(TelemetryDisabled, 1, func(seg int, p [][]byte) [][]byte {
+		if seg == 2 {
+			p[30] = testPacket(maxPacketNum, seg, 0)
+		}
+		return p
+	})
+	// A frame where the last packet of segment 2 was lost.
+	lost := testFrameWith(TelemetryHeader, 1, func(seg int, p [][]byte) [][]byte {
+		if seg == 2 {
+			return withoutPacket(p, maxPacketNum)
+		}
+		return p
+	})
+	tests := []struct {
+		name      string
+		layout    TelemetryLayout // expected by the frame builder
+		stream    [][]byte
+		frames    int
+		layoutErr bool
+	}{
+		{"telemetry on", TelemetryHeader, concatPackets(testFrame(TelemetryHeader, 1), testFrame(TelemetryHeader, 1)), 2, false},
+		{"telemetry off", TelemetryDisabled, concatPackets(testFrame(TelemetryDisabled, 1), testFrame(TelemetryDisabled, 1)), 2, false},
+		{"missing telemetry", TelemetryHeader, testFrame(TelemetryDisabled, 1), 0, true},
+		{"unexpected telemetry", TelemetryDisabled, testFrame(TelemetryHeader, 1), 0, true},
+		{"lost last packet", TelemetryHeader, concatPackets(lost, testFrame(TelemetryHeader, 1)), 1, false},
+		{"corrupt packet number", TelemetryDisabled, concatPackets(corrupt, testFrame(TelemetryDisabled, 1)), 1, false},
+	}
+	for _, tt := range tests {
+		f := newFrameBuilder()
+		f.strict = true
+		f.setTelemetryLayout(tt.layout)
+		frames, _, err := feedWithResync(f, tt.stream)
+		if (err != nil) != tt.layoutErr {
+			t.Errorf("%s: got layout error %v, want %v", tt.name, err, tt.layoutErr)
+		}
+		if frames != tt.frames {
+			t.Errorf("%s: got %d frames, want %d", tt.name, frames, tt.frames)
+		}
+	}
+}
+
+func TestFrameBuilderTelemetryLayout(t *testing.T) {
+	tests := []struct {
+		layout TelemetryLayout
+		// Index, counting from the first packet of segment 1, of
+		// the first telemetry and first pixel packet. A
+		// telemetry index of -1 means there is no telemetry.
+		telemetry int
+		pixels    int
+	}{
+		{TelemetryHeader, 0, telemetryPacketCount},
+		{TelemetryFooter, segmentsPerFrame*packetsPerSegment - telemetryPacketCount, 0},
+		{TelemetryDisabled, -1, 0},
+	}
+	for _, tt := range tests {
+		perSegment := packetsPerSegment
+		if !tt.layout.enabled() {
+			perSegment--
+		}
+		// Label each packet with its segment and packet number.
+		var stream [][]byte
+		for seg := 1; seg <= segmentsPerFrame; seg++ {
+			for _, p := range testSegment(tt.layout, seg, 0xee) {
+				p[vospiHeaderSize] = byte(seg)
+				p[vospiHeaderSize+1] = p[1]
+				stream = append(stream, p)
+			}
+		}
+		// source returns the label of packet index i.
+		source := func(i int) [2]byte {
+			return [2]byte{byte(i/perSegment + 1), byte(i % perSegment)}
+		}
+
+		f := newFrameBuilder()
+		f.strict = true
+		f.setTelemetryLayout(tt.layout)
+		complete, err := feedPackets(t, f, stream)
+		if err != nil || !complete {
+			t.Fatalf("layout %d: complete = %v, err = %v", tt.layout, complete, err)
+		}
+		if tel := f.telemetryData(); tt.telemetry < 0 && tel != nil {
+			t.Errorf("layout %d: telemetry data returned", tt.layout)
+		} else if tt.telemetry >= 0 && [2]byte{tel[0], tel[1]} != source(tt.telemetry) {
+			t.Errorf("layout %d: telemetry data came from %v", tt.layout, tel[:2])
+		}
+		if pix := f.pixelData(); [2]byte{pix[0], pix[1]} != source(tt.pixels) {
+			t.Errorf("layout %d: pixel data came from %v", tt.layout, pix[:2])
+		}
+
+		raw := NewRawFrame()
+		for i := range raw {
+			raw[i] = 0xff
+		}
+		f.output(raw)
+
+		for i := 0; i < telemetryPacketCount; i++ {
+			got := [2]byte{raw[i*vospiDataSize], raw[i*vospiDataSize+1]}
+			want := [2]byte{}
+			if tt.telemetry >= 0 {
+				want = source(tt.telemetry + i)
+			}
+			if got != want {
+				t.Errorf("layout %d: telemetry packet %d came from %v, want %v", tt.layout, i, got, want)
+			}
+		}
+		for row := 0; row < FrameRows; row++ {
+			for half := 0; half < 2; half++ {
+				i := row*2 + half
+				offset := telemetryBytes + i*vospiDataSize
+				got := [2]byte{raw[offset], raw[offset+1]}
+				if want := source(tt.pixels + i); got != want {
+					t.Errorf("layout %d: row %d half %d came from %v, want %v", tt.layout, row, half, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFrameBuilderSegmentRepeat(t *testing.T) {
+	seg := func(n int, fill byte) [][]byte {
+		return testSegment(TelemetryHeader, n, fill)
+	}
+	tests := []struct {
+		name   string
+		policy SegmentRepeatPolicy
+		stream [][]byte
+		want   []byte // first byte of each segment, nil for no frame
+	}{
+		{
+			name:   "replace",
+			policy: SegmentRepeatReplace,
+			stream: concatPackets(seg(1, 1), seg(2, 2), seg(2, 22), seg(3, 3), seg(4, 4)),
+			want:   []byte{1, 22, 3, 4},
+		},
+		{
+			name:   "replace last",
+			policy: SegmentRepeatReplace,
+			stream: concatPackets(seg(1, 1), seg(2, 2), seg(3, 3), seg(3, 33), seg(4, 4)),
+			want:   []byte{1, 2, 33, 4},
+		},
+		{
+			name:   "replace first",
+			policy: SegmentRepeatReplace,
+			stream: concatPackets(seg(1, 1), seg(1, 11), seg(2, 2), seg(3, 3), seg(4, 4)),
+			want:   []byte{11, 2, 3, 4},
+		},
+		{
+			name:   "restart",
+			policy: SegmentRepeatRestart,
+			stream: concatPackets(seg(1, 1), seg(2, 2), seg(2, 22), seg(3, 3), seg(4, 4)),
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		f := newFrameBuilder()
+		f.strict = true
+		f.repeat = tt.policy
+		complete, err := feedPackets(t, f, tt.stream)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if complete != (tt.want != nil) {
+			t.Errorf("%s: complete = %v", tt.name, complete)
+			continue
+		}
+		if tt.want != nil && f.outOfOrderSegments != 0 {
+			t.Errorf("%s: repeat counted as out of order", tt.name)
+		}
+		for i, fill := range tt.want {
+			if got := f.frameBuf[i*packetsPerSegment*vospiDataSize]; got != fill {
+				t.Errorf("%s: segment %d = %d, want %d", tt.name, i+1, got, fill)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import "time"
+
+// FrameInfo describes how the most recent frame returned by NextFrame
+// was assembled.
+type FrameInfo struct {
+	// Sequence is a number assigned by the host to each frame
+	// returned by NextFrame, starting at 1 for the first frame after
+	// Open and increasing by 1 for every frame. Unlike the telemetry
+	// frame counter it is always available. A gap between the
+	// sequence numbers of frames a consumer processes shows that it
+	// skipped frames.
+	Sequence uint64
+
+	// BadPackets is the number of packets which were rejected while
+	// reading the frame, either because they failed validation
+	// (including CRC errors) or arrived out of sequence.
+	BadPackets int
+
+	// CRCErrors is the number of packets (included in BadPackets)
+	// which were rejected due to a CRC mismatch. This is always 0
+	// unless CRC checking is enabled.
+	CRCErrors int
+
+	// Resyncs is the number of times the connection to the camera
+	// was resynchronised while reading the frame.
+	Resyncs int
+
+	// Timeouts is the number of frame timeouts while reading the
+	// frame. NextFrame gives up after a timeout, so this is only
+	// ever more than 1 for SnapshotWithInfo, which recovers from
+	// them.
+	Timeouts int
+
+	// Packets is the total number of packets (excluding the discard
+	// packets the camera sends between segments) read while
+	// assembling the frame, including those which were rejected or
+	// belonged to incomplete or invalid segments. A frame is made up
+	// of 4 segments of 61 packets, or 60 packets with
+	// TelemetryDisabled.
+	Packets int
+
+	// DiscardedPackets is the number of packets in Packets which
+	// didn't end up in the frame. As the camera outputs segments
+	// which aren't part of a valid frame this is normally well above
+	// zero, but a rising ratio of DiscardedPackets to Packets is an
+	// early sign of a degrading link, even while frames still
+	// complete.
+	DiscardedPackets int
+
+	// Integrity is a score between 0 and 1 indicating how cleanly
+	// the frame was received. It is calculated as:
+	//
+	//   framePackets / (framePackets + BadPackets + Resyncs * framePackets)
+	//
+	// where framePackets is the number of packets making up a frame
+	// (see Packets), so a frame received without any problems scores
+	// 1, and every resync counts as much as losing a whole frame.
+	// Scores are comparable between frames.
+	Integrity float64
+
+	// Stats holds the frame's pixel statistics. These are calculated
+	// during assembly so are available even when the frame itself
+	// isn't output (see SetStatsOnly).
+	Stats PixelStats
+
+	// RangeUsed is the fraction of the camera's 14-bit output range
+	// spanned by the frame's pixels (see PixelStats.RangeUsed).
+	RangeUsed float64
+
+	// Timing breaks down where the time was spent reading the
+	// frame. It is only populated when enabled using
+	// SetFrameTiming.
+	Timing FrameTiming
+}
+
+// FrameTiming breaks down the time NextFrame spent reading a frame by
+// phase. This shows whether a bottleneck is in receiving packets from
+// the camera or in processing them.
+type FrameTiming struct {
+	// Waiting is the time spent waiting for packets from the
+	// streaming goroutine (i.e. the SPI transfers and channel).
+	Waiting time.Duration
+
+	// Assembling is the time spent validating packets and
+	// assembling them into a frame, including any resyncs.
+	Assembling time.Duration
+
+	// Output is the time spent writing the assembled frame to the
+	// output slice.
+	Output time.Duration
+}
+
+// SetFrameTiming enables or disables the measurement of per-phase
+// frame timing, reported in FrameInfo.Timing. It is disabled by
+// default, in which case it adds no overhead.
+func (d *Lepton3) SetFrameTiming(enable bool) {
+	d.frameTiming = enable
+}
+
+// phaseTimer accumulates the time elapsed between calls to mark. It
+// uses the monotonic clock so is unaffected by changes to the wall
+// clock.
+type phaseTimer struct {
+	last time.Time
+}
+
+func (t *phaseTimer) start() {
+	t.last = time.Now()
+}
+
+// mark adds the time since the previous mark to d.
+func (t *phaseTimer) mark(d *time.Duration) {
+	now := time.Now()
+	*d += now.Sub(t.last)
+	t.last = now
+}
+
+func (i *FrameInfo) reset() {
+	*i = FrameInfo{}
+}
+
+// addCounts adds the packet and recovery counts from other, which
+// describes an earlier attempt at reading the same frame.
+func (i *FrameInfo) addCounts(other *FrameInfo) {
+	i.BadPackets += other.BadPackets
+	i.CRCErrors += other.CRCErrors
+	i.Resyncs += other.Resyncs
+	i.Timeouts += other.Timeouts
+	i.Packets += other.Packets
+	i.Timing.Waiting += other.Timing.Waiting
+	i.Timing.Assembling += other.Timing.Assembling
+	i.Timing.Output += other.Timing.Output
+}
+
+// finish fills in the fields derived from the packet counts, given
+// the number of packets which make up a frame.
+func (i *FrameInfo) finish(framePackets int) {
+	i.DiscardedPackets = i.Packets - framePackets
+	i.Integrity = float64(framePackets) /
+		float64(framePackets+i.BadPackets+i.Resyncs*framePackets)
+}
+
+// LastFrameInfo returns information about how the most recent frame
+// returned by NextFrame was assembled.
+func (d *Lepton3) LastFrameInfo() FrameInfo {
+	return d.frameInfo
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sync"
+)
+
+// SnapshotHandler is an http.Handler which returns the most recent
+// frame as a colourised JPEG. It suits simple polling clients and
+// dashboards which only need an occasional image.
+//
+// The handler doesn't read from the camera itself, so it doesn't
+// interrupt an active stream. Instead the application's capture loop
+// passes it each frame (or only some of them) using Update, and
+// reports capture failures using Fail. For example:
+//
+//	snap := lepton3.NewSnapshotHandler(nil, lepton3.IronPalette)
+//	http.Handle("/snapshot.jpg", snap)
+//	err := camera.RunCapture(ctx, func(img *image.Gray16) error {
+//		snap.Update(img)
+//		return nil
+//	})
+//	snap.Fail(err)
+//
+// Requests made before the first frame, or after a failure, receive a
+// 503 (Service Unavailable) response.
+type SnapshotHandler struct {
+	agc     AGC
+	palette Palette
+
+	// Quality is the JPEG quality (1-100) used. It must not be
+	// changed while requests are being served.
+	Quality int
+
+	mu    sync.Mutex
+	frame *image.Gray16
+	err   error
+
+	// renderMu serialises use of agc, which may keep state between
+	// frames.
+	renderMu sync.Mutex
+}
+
+// NewSnapshotHandler returns a SnapshotHandler which converts frames
+// to 8-bit using agc (MinMaxAGC if nil) and then colours them using
+// palette (GrayPalette if nil), which must have 256 entries.
+func NewSnapshotHandler(agc AGC, palette Palette) *SnapshotHandler {
+	if agc == nil {
+		agc = MinMaxAGC{}
+	}
+	if palette == nil {
+		palette = GrayPalette
+	}
+	if len(palette) != 256 {
+		panic("lepton3: palette must have 256 entries")
+	}
+	return &SnapshotHandler{
+		agc:     agc,
+		palette: palette,
+		Quality: jpeg.DefaultQuality,
+	}
+}
+
+// Update stores a copy of img as the frame to serve and clears any
+// failure reported using Fail. It can be called directly from a
+// RunCapture handler as the image passed in isn't retained.
+func (h *SnapshotHandler) Update(img *image.Gray16) {
+	frame := CloneGray16(img)
+	h.mu.Lock()
+	h.frame = frame
+	h.err = nil
+	h.mu.Unlock()
+}
+
+// Fail records that capture has failed. Until the next Update,
+// requests receive a 503 response including err. A nil err is
+// ignored.
+func (h *SnapshotHandler) Fail(err error) {
+	if err == nil {
+		return
+	}
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	img, err := h.render()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	jpeg.Encode(w, img, &jpeg.Options{Quality: h.Quality})
+}
+
+// render converts the current frame to a colour image. Update
+// replaces rather than modifies the stored frame, so the lock is only
+// held while fetching it and Update isn't blocked by encoding.
+func (h *SnapshotHandler) render() (*image.RGBA, error) {
+	h.mu.Lock()
+	if h.err != nil {
+		err := h.err
+		h.mu.Unlock()
+		return nil, err
+	}
+	src := h.frame
+	h.mu.Unlock()
+	if src == nil {
+		return nil, errors.New("no frame captured yet")
+	}
+
+	h.renderMu.Lock()
+	defer h.renderMu.Unlock()
+	return Colorize(src, h.agc, h.palette)
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getSnapshot(h *SnapshotHandler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/snapshot.jpg", nil))
+	return w
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	h := NewSnapshotHandler(nil, IronPalette)
+	if w := getSnapshot(h); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("before first frame: got status %d", w.Code)
+	}
+
+	img := NewGray16()
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	h.Update(img)
+	// The handler must not retain the caller's image.
+	img.Pix[0] = 0xff
+
+	w := getSnapshot(h)
+	if w.Code != http.StatusOK {
+		t.Fatalf("after Update: got status %d: %s", w.Code, w.Body)
+	}
+	out, err := jpeg.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := out.Bounds(); b != image.Rect(0, 0, FrameCols, FrameRows) {
+		t.Errorf("got bounds %v", b)
+	}
+	if h.frame.Pix[0] == 0xff {
+		t.Error("Update didn't copy the image")
+	}
+
+	h.Fail(errors.New("camera gone"))
+	if w := getSnapshot(h); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("after Fail: got status %d", w.Code)
+	}
+	h.Update(img)
+	if w := getSnapshot(h); w.Code != http.StatusOK {
+		t.Errorf("after recovery: got status %d", w.Code)
+	}
+}
+
+func ExampleSnapshotHandler() {
+	var camera *Lepton3 // opened elsewhere
+	ctx := context.Background()
+
+	snap := NewSnapshotHandler(nil, IronPalette)
+	http.Handle("/snapshot.jpg", snap)
+	err := camera.RunCapture(ctx, func(img *image.Gray16) error {
+		snap.Update(img)
+		return nil
+	})
+	snap.Fail(err)
+}
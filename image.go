@@ -0,0 +1,224 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+// NewGray16 returns an image.Gray16 sized for a single Lepton 3 frame.
+func NewGray16() *image.Gray16 {
+	return image.NewGray16(image.Rect(0, 0, FrameCols, FrameRows))
+}
+
+// ToGray16 copies the pixels of frame into dst, which should be
+// created using NewGray16.
+func ToGray16(frame *cptvframe.Frame, dst *image.Gray16) {
+	for y, row := range frame.Pix {
+		i := dst.PixOffset(0, y)
+		for _, val := range row {
+			binary.BigEndian.PutUint16(dst.Pix[i:], val)
+			i += 2
+		}
+	}
+}
+
+// ToGray16Depth is like ToGray16 but reduces the pixel values to the
+// given bit depth (1-16), right aligned, for displays which expect
+// less than 16 bits per pixel. The camera produces 14-bit values, so
+// for depths below 14 each value is shifted right by (14 - bits) to
+// keep the most significant bits. For depths of 14 or more the values
+// are unchanged. Values are masked to the requested depth.
+func ToGray16Depth(frame *cptvframe.Frame, dst *image.Gray16, bits int) error {
+	if bits < 1 || bits > 16 {
+		return fmt.Errorf("invalid bit depth: %d", bits)
+	}
+	var shift uint
+	if bits < nativeBitDepth {
+		shift = uint(nativeBitDepth - bits)
+	}
+	mask := uint16(1<<uint(bits) - 1)
+	for y, row := range frame.Pix {
+		i := dst.PixOffset(0, y)
+		for _, val := range row {
+			binary.BigEndian.PutUint16(dst.Pix[i:], (val>>shift)&mask)
+			i += 2
+		}
+	}
+	return nil
+}
+
+// The bit depth of the camera's raw pixel values.
+const nativeBitDepth = 14
+
+// RawImage is an image.Image which decodes pixels from a raw frame
+// (as returned by NextFrame) on demand rather than up front. This
+// avoids converting the whole frame when only a few pixels are
+// sampled.
+//
+// A RawImage refers directly to the raw frame it was created from, so
+// it is only valid until that frame is overwritten (typically by the
+// next call to NextFrame). Use Freeze to take a copy which outlives
+// the raw frame.
+type RawImage struct {
+	raw []byte
+}
+
+var _ image.Image = (*RawImage)(nil)
+
+// NewRawImage returns a RawImage backed by raw, which must be a raw
+// frame created using NewRawFrame.
+func NewRawImage(raw []byte) *RawImage {
+	return &RawImage{raw: raw}
+}
+
+// ColorModel implements image.Image.
+func (r *RawImage) ColorModel() color.Model {
+	return color.Gray16Model
+}
+
+// Bounds implements image.Image.
+func (r *RawImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, FrameCols, FrameRows)
+}
+
+// At implements image.Image.
+func (r *RawImage) At(x, y int) color.Color {
+	return r.Gray16At(x, y)
+}
+
+// Gray16At returns the value of the pixel at (x, y) without the
+// allocation involved in returning a color.Color. Points outside the
+// frame return zero.
+func (r *RawImage) Gray16At(x, y int) color.Gray16 {
+	if !(image.Point{x, y}.In(r.Bounds())) {
+		return color.Gray16{}
+	}
+	i := telemetryBytes + (y*FrameCols+x)*2
+	return color.Gray16{Y: binary.BigEndian.Uint16(r.raw[i:])}
+}
+
+// Freeze returns a copy of the image as an image.Gray16 which remains
+// valid after the raw frame is overwritten.
+func (r *RawImage) Freeze() *image.Gray16 {
+	img := NewGray16()
+	// Both the raw frame and image.Gray16 store pixels as big endian
+	// values in row major order.
+	copy(img.Pix, r.raw[telemetryBytes:])
+	return img
+}
+
+// CopyFrame returns the pixels of a raw frame as a new image.Gray16
+// which the caller owns. It can be retained or sent on a channel after
+// raw is overwritten by the next call to NextFrame.
+func CopyFrame(raw []byte) *image.Gray16 {
+	return NewRawImage(raw).Freeze()
+}
+
+// CloneGray16 returns an independent copy of img with the same bounds.
+// Use it to retain images which are reused by the package, such as
+// the image passed to a RunCapture handler.
+func CloneGray16(img *image.Gray16) *image.Gray16 {
+	b := img.Bounds()
+	dst := image.NewGray16(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		copy(dst.Pix[dst.PixOffset(b.Min.X, y):], img.Pix[i:i+b.Dx()*2])
+	}
+	return dst
+}
+
+// Downscale returns a box averaged copy of src which is smaller by
+// factor in both dimensions. For a full Lepton 3 frame a factor of 2
+// gives an 80x60 image and a factor of 4 gives 40x30.
+func Downscale(src *image.Gray16, factor int) (*image.Gray16, error) {
+	if factor < 1 {
+		return nil, fmt.Errorf("invalid downscale factor: %d", factor)
+	}
+	b := src.Bounds()
+	dst := image.NewGray16(image.Rect(0, 0, b.Dx()/factor, b.Dy()/factor))
+	if err := DownscaleInto(src, dst, factor); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// DownscaleInto is like Downscale but writes into a caller provided
+// image to avoid allocation. dst must be exactly 1/factor the size of
+// src. Any rows or columns of src which don't fill a complete box are
+// ignored.
+func DownscaleInto(src, dst *image.Gray16, factor int) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid downscale factor: %d", factor)
+	}
+	sb, db := src.Bounds(), dst.Bounds()
+	if db.Dx() != sb.Dx()/factor || db.Dy() != sb.Dy()/factor {
+		return fmt.Errorf("output size %v doesn't match %v / %d", db.Size(), sb.Size(), factor)
+	}
+
+	area := uint32(factor * factor)
+	for dy := 0; dy < db.Dy(); dy++ {
+		for dx := 0; dx < db.Dx(); dx++ {
+			var sum uint32
+			for y := 0; y < factor; y++ {
+				i := src.PixOffset(sb.Min.X+dx*factor, sb.Min.Y+dy*factor+y)
+				for x := 0; x < factor; x++ {
+					sum += uint32(binary.BigEndian.Uint16(src.Pix[i:]))
+					i += 2
+				}
+			}
+			j := dst.PixOffset(db.Min.X+dx, db.Min.Y+dy)
+			binary.BigEndian.PutUint16(dst.Pix[j:], uint16((sum+area/2)/area))
+		}
+	}
+	return nil
+}
+
+// DiffFrames returns the signed per-pixel difference a - b in row
+// major order. Differences beyond the range of an int16 are
+// saturated. a and b must have the same bounds.
+func DiffFrames(a, b *image.Gray16) ([]int16, error) {
+	out := make([]int16, a.Bounds().Dx()*a.Bounds().Dy())
+	if err := DiffFramesInto(a, b, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DiffFramesInto is like DiffFrames but writes into a caller provided
+// slice, which must hold one value per pixel.
+func DiffFramesInto(a, b *image.Gray16, out []int16) error {
+	ab := a.Bounds()
+	if ab != b.Bounds() {
+		return fmt.Errorf("image bounds don't match: %v != %v", ab, b.Bounds())
+	}
+	if len(out) < ab.Dx()*ab.Dy() {
+		return fmt.Errorf("output too small: %d < %d", len(out), ab.Dx()*ab.Dy())
+	}
+	k := 0
+	for y := ab.Min.Y; y < ab.Max.Y; y++ {
+		i := a.PixOffset(ab.Min.X, y)
+		j := b.PixOffset(ab.Min.X, y)
+		for x := ab.Min.X; x < ab.Max.X; x++ {
+			diff := int32(binary.BigEndian.Uint16(a.Pix[i:])) - int32(binary.BigEndian.Uint16(b.Pix[j:]))
+			if diff > math.MaxInt16 {
+				diff = math.MaxInt16
+			} else if diff < math.MinInt16 {
+				diff = math.MinInt16
+			}
+			out[k] = int16(diff)
+			i += 2
+			j += 2
+			k++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+// patternValue is the value of the pixel at x, y in the known pattern.
+func patternValue(x, y int) uint16 {
+	return uint16(y<<8 | x)
+}
+
+// patternFrame returns the packets of a frame (TelemetryHeader) where
+// each pixel's value encodes its position (see patternValue). Each
+// image packet holds colsPerPacket pixels of a row: even image
+// packets the left half and odd packets the right half.
+func patternFrame() [][]byte {
+	var packets [][]byte
+	imagePacket := -telemetryPacketCount
+	for seg := 1; seg <= segmentsPerFrame; seg++ {
+		for _, p := range testSegment(TelemetryHeader, seg, 0) {
+			if imagePacket >= 0 {
+				y := imagePacket / 2
+				x0 := (imagePacket % 2) * colsPerPacket
+				for i := 0; i < colsPerPacket; i++ {
+					binary.BigEndian.PutUint16(p[vospiHeaderSize+i*2:], patternValue(x0+i, y))
+				}
+				binary.BigEndian.PutUint16(p[2:], packetCRC(p))
+			}
+			imagePacket++
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func TestPacketToPixelMapping(t *testing.T) {
+	d := NewDecoder()
+	d.CheckCRC = true
+	if frames := decodeAll(t, d, patternFrame()); frames != 1 {
+		t.Fatalf("%d frames decoded", frames)
+	}
+	raw := NewRawFrame()
+	d.Frame(raw)
+
+	frame := cptvframe.NewFrame(&Lepton3{})
+	if err := ParseRawFrame(raw, frame); err != nil {
+		t.Fatal(err)
+	}
+	img := NewGray16()
+	ToGray16(frame, img)
+	rawImg := NewRawImage(raw)
+	// NativePixels must leave raw unchanged for rawImg.
+	pix := make([]byte, FrameRows*FrameCols*2)
+	if err := NativePixels(raw, pix); err != nil {
+		t.Fatal(err)
+	}
+	var native binary.ByteOrder = binary.BigEndian
+	if nativeLittleEndian {
+		native = binary.LittleEndian
+	}
+
+	for y := 0; y < FrameRows; y++ {
+		for x := 0; x < FrameCols; x++ {
+			want := patternValue(x, y)
+			if got := img.Gray16At(x, y).Y; got != want {
+				t.Fatalf("image pixel (%d, %d) = %d (row %d, col %d), want row %d, col %d",
+					x, y, got, got>>8, got&0xff, y, x)
+			}
+			if got := rawImg.Gray16At(x, y).Y; got != want {
+				t.Fatalf("raw image pixel (%d, %d) = %d (row %d, col %d), want row %d, col %d",
+					x, y, got, got>>8, got&0xff, y, x)
+			}
+			if got := native.Uint16(pix[(y*FrameCols+x)*2:]); got != want {
+				t.Fatalf("native pixel (%d, %d) = %d (row %d, col %d), want row %d, col %d",
+					x, y, got, got>>8, got&0xff, y, x)
+			}
+		}
+	}
+}
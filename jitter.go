@@ -0,0 +1,76 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"math"
+	"time"
+)
+
+// JitterStats summarises the intervals between segments being
+// completed (see SetSegmentJitter). The camera outputs segments at a
+// steady rate (about 106 Hz, including segments which aren't part of
+// a valid frame), so variation in the intervals comes from the host.
+// Intervals are measured from when the SPI transfer holding the last
+// packet of each segment completed, so they reflect SPI timing
+// problems rather than how promptly NextFrame is called. High jitter
+// tends to precede frame loss.
+type JitterStats struct {
+	Count  uint64 // number of intervals measured
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// SetSegmentJitter enables or disables measurement of segment arrival
+// jitter, reported in Stats.SegmentJitter. Enabling resets the
+// statistics. It is disabled by default.
+func (d *Lepton3) SetSegmentJitter(enable bool) {
+	d.statsMu.Lock()
+	d.stats.SegmentJitter = JitterStats{}
+	d.statsMu.Unlock()
+	d.jitter = jitterState{}
+	d.segmentJitter = enable
+}
+
+// jitterState accumulates the running mean and variance of segment
+// intervals (in seconds) using Welford's algorithm.
+type jitterState struct {
+	last     time.Time
+	n        float64
+	mean, m2 float64
+}
+
+// markSegment records the completion of a segment, whose last packet
+// was read at now.
+func (d *Lepton3) markSegment(now time.Time) {
+	j := &d.jitter
+	if j.last.IsZero() {
+		j.last = now
+		return
+	}
+	interval := now.Sub(j.last)
+	j.last = now
+
+	x := interval.Seconds()
+	j.n++
+	delta := x - j.mean
+	j.mean += delta / j.n
+	j.m2 += delta * (x - j.mean)
+
+	d.statsMu.Lock()
+	s := &d.stats.SegmentJitter
+	if s.Count == 0 || interval < s.Min {
+		s.Min = interval
+	}
+	if interval > s.Max {
+		s.Max = interval
+	}
+	s.Count++
+	s.Mean = time.Duration(j.mean * float64(time.Second))
+	s.StdDev = time.Duration(math.Sqrt(j.m2/j.n) * float64(time.Second))
+	d.statsMu.Unlock()
+}
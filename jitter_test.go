@@ -0,0 +1,41 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSegmentJitterUsesReadTime(t *testing.T) {
+	spiConn := new(fakeSPI)
+	// Both frames fit in the packet buffer so they are read from
+	// the camera back to back.
+	spiConn.send(testFrame(TelemetryHeader, 1)...)
+	spiConn.send(testFrame(TelemetryHeader, 1)...)
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	d.SetSegmentJitter(true)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	raw := NewRawFrame()
+	if err := d.NextFrame(raw); err != nil {
+		t.Fatal(err)
+	}
+	// A slow consumer mustn't show up as jitter.
+	const delay = 200 * time.Millisecond
+	time.Sleep(delay)
+	if err := d.NextFrame(raw); err != nil {
+		t.Fatal(err)
+	}
+	jitter := d.Stats().SegmentJitter
+	if jitter.Count != 2*segmentsPerFrame-1 {
+		t.Errorf("measured %d intervals, want %d", jitter.Count, 2*segmentsPerFrame-1)
+	}
+	if jitter.Max >= delay {
+		t.Errorf("max interval %v includes the consumer's delay", jitter.Max)
+	}
+}
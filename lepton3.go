@@ -6,11 +6,15 @@ package lepton3
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	tomb "gopkg.in/tomb.v2"
@@ -47,20 +51,85 @@ const (
 	telemetryBytes       = telemetryPacketCount * vospiDataSize
 
 	// SPI transfer
-	packetsPerRead     = 128
-	transferSize       = vospiPacketSize * packetsPerRead
+	spiMode            = spi.Mode3
+	spiBitsPerWord     = 8
+	packetsPerRead     = 128 // default, see SetTransferSize
 	packetChSize       = 512
 	maxPacketsPerFrame = 1500 // including discards and then rounded up somewhat
 
+	// The largest transfer size allowed by SetTransferSize.
+	maxPacketsPerTransfer = 512
+
+	// The camera outputs segments (valid or not) at about 106 Hz.
+	// Transfers must be frequent enough to keep up with this with
+	// plenty of headroom, so the transfer rate can't be capped below
+	// twice the rate needed to read every segment (see
+	// minTransferRate).
+	segmentsPerSecond = 106
+
 	// Packet bitmasks
 	packetHeaderDiscard = 0x0F
 	packetNumMask       = 0x0FFF
 
-	// The maximum time a single frame read is allowed to take
-	// (including resync attempts)
-	frameTimeout = 10 * time.Second
+	// The default maximum number of resyncs allowed while reading
+	// a single frame.
+	defaultMaxResyncs = 5
+
+	// The number of frame timeouts SnapshotWithInfo recovers from
+	// before giving up.
+	snapshotTimeoutRetries = 2
+
+	// How long to wait for the camera to come back after a reboot,
+	// and how long to give it to start rebooting before polling.
+	rebootTimeout = 10 * time.Second
+	rebootSettle  = 500 * time.Millisecond
+
+	// If no usable packets (i.e. only discard or all-zero packets)
+	// are read over this window, the camera is considered
+	// disconnected.
+	disconnectWindow = 2 * time.Second
+
+	// A gap in usable packets longer than this (but shorter than
+	// disconnectWindow) is treated as a pause in the stream, such
+	// as the camera performing an FFC, rather than a fault.
+	streamPauseThreshold = 150 * time.Millisecond
 )
 
+// The maximum time a single frame read is allowed to take (including
+// resync attempts). This is a variable so that tests can shorten it.
+var frameTimeout = 10 * time.Second
+
+// errFrameTimeout is returned by NextFrame when a frame read takes
+// longer than frameTimeout.
+var errFrameTimeout = errors.New("frame timeout")
+
+// ErrCameraDisconnected is returned by NextFrame when the SPI bus
+// has only returned discard or all-zero packets for an extended
+// period, which is what happens when the camera isn't physically
+// connected.
+var ErrCameraDisconnected = errors.New("camera appears to be disconnected (no usable packets)")
+
+// ErrTooManyResyncs is returned by NextFrame when the maximum number
+// of resyncs allowed for a single frame is exceeded (see
+// SetMaxResyncs). This usually indicates the camera is unhealthy.
+var ErrTooManyResyncs = errors.New("too many resyncs while reading frame")
+
+// ErrNotOpen is returned by NextFrame when the camera hasn't been
+// opened.
+var ErrNotOpen = errors.New("camera is not open")
+
+// ErrWarmingUp is returned by NextFrame when the camera is still
+// warming up and WarmupReport is selected (see SetWarmupPolicy).
+var ErrWarmingUp = errors.New("camera is warming up")
+
+// ErrPaused is returned by NextFrame when streaming has been paused.
+var ErrPaused = errors.New("streaming is paused")
+
+// ErrStaleFrame is returned by NextFrame when a frame timeout occurs
+// and the stale frame fallback is enabled (see SetStaleOnTimeout). The
+// output frame holds a copy of the last good frame.
+var ErrStaleFrame = errors.New("frame timeout, returned last good frame")
+
 func (l *Lepton3) ResX() int {
 	return FrameCols
 }
@@ -71,9 +140,41 @@ func (l *Lepton3) FPS() int {
 	return FramesHz
 }
 
-// New returns a new Lepton3 instance.
+// New returns a new Lepton3 instance using the default SPI port and
+// I2C bus.
 func New(spiSpeed int64) (*Lepton3, error) {
-	cciDev, err := openCCI()
+	return NewWithDevices(spiSpeed, "", "")
+}
+
+// SPIPortName returns the name of the SPI port for the given bus and
+// chip select (CS) line, for use with NewWithDevices. This allows a
+// specific camera to be addressed when several devices share an SPI
+// bus using separate chip select lines. An error is returned if no
+// such port is available. host.Init must have been called first.
+func SPIPortName(bus, cs int) (string, error) {
+	if bus < 0 || cs < 0 {
+		return "", fmt.Errorf("invalid SPI bus %d or chip select %d", bus, cs)
+	}
+	alias := fmt.Sprintf("SPI%d.%d", bus, cs)
+	for _, ref := range spireg.All() {
+		if ref.Name == alias {
+			return ref.Name, nil
+		}
+		for _, a := range ref.Aliases {
+			if a == alias {
+				return ref.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no SPI port for bus %d chip select %d", bus, cs)
+}
+
+// NewWithDevices returns a new Lepton3 instance using the named SPI
+// port and I2C bus (as understood by periph's spireg and i2creg). An
+// empty name selects the default device. This allows multiple cameras
+// to be used, each connected to its own buses.
+func NewWithDevices(spiSpeed int64, spiName, i2cName string) (*Lepton3, error) {
+	cciDev, err := openCCI(i2cName)
 	if err != nil {
 		return nil, err
 	}
@@ -84,37 +185,321 @@ func New(spiSpeed int64) (*Lepton3, error) {
 		return nil, err
 	}
 
-	// The ring buffer is used to avoid memory allocations for SPI
-	// transfers. We aim to have it big enough to handle all the SPI
-	// transfers for at least a 3 frames.
-	ringChunks := 3 * int(math.Ceil(float64(maxPacketsPerFrame)/float64(packetsPerRead)))
 	return &Lepton3{
-		cciDev:       cciDev,
-		spiSpeed:     spiSpeed,
-		ring:         newRing(ringChunks, transferSize),
-		frameBuilder: newFrameBuilder(),
-		log:          func(string) {},
+		cciDev:         cciDev,
+		spiSpeed:       spiSpeed,
+		nextSpeed:      spiSpeed,
+		spiName:        spiName,
+		i2cName:        i2cName,
+		ring:           newTransferRing(packetsPerRead),
+		packetsPerRead: packetsPerRead,
+		frameBuilder:   newFrameBuilder(),
+		log:            func(string) {},
+		logLevel:       LogInfo,
+		zeroCRCDiscard: true,
+		tempConv:       NewTempConverter(),
+		maxResyncs:     defaultMaxResyncs,
 	}, nil
 }
 
 // Lepton3 manages a connection to an FLIR Lepton 3 camera. It is not
-// goroutine safe.
+// goroutine safe, except that NextFrame may be called concurrently
+// with WithCCI, and IsOpen and Stats may be called at any time.
 type Lepton3 struct {
-	cciDev       *closingCCIDev
-	spiSpeed     int64
-	spiPort      spi.PortCloser
-	spiConn      spi.Conn
-	packetCh     chan []byte
-	tomb         *tomb.Tomb
-	ring         *ring
-	frameBuilder *frameBuilder
-	log          func(string)
+	cciDev         *closingCCIDev
+	spiSpeed       int64
+	spiName        string
+	i2cName        string
+	spiPort        spi.PortCloser
+	spiConn        spi.Conn
+	packetCh       chan rxPacket
+	freePackets    chan []byte // packet slots, see sendPacket
+	heldPacket     rxPacket    // being processed by NextFrame
+	rxSeq          uint32      // of the last packet received
+	tomb           *tomb.Tomb
+	ring           *ring
+	packetsPerRead int
+	frameBuilder   *frameBuilder
+	log            func(string)
+	logLevel       LogLevel // accessed atomically
+
+	crcCheck       bool
+	zeroCRCDiscard bool
+	tempConv       *TempConverter
+	tlinear        bool
+	tlinearKnown   bool
+	skipFFCFrames  bool
+	statsOnly      bool
+	latestFrame    bool
+	latestBuf      []byte
+	txInterval     time.Duration
+	frameInfo      FrameInfo
+	frameSeq       uint64
+	frameTimer     *time.Timer
+	frameTiming    bool
+	opened         int32 // accessed atomically
+	lastGoodFrame  []byte
+	haveGoodFrame  bool
+	maxResyncs     int
+	warmup         WarmupPolicy
+
+	// Adaptive SPI speed (see SetAdaptiveSpeed)
+	adaptive      *AdaptiveSpeed
+	nextSpeed     int64
+	openSpeed     int64
+	windowFrames  int
+	windowResyncs int
+
+	// RunCapture change suppression (see SetChangeThreshold)
+	changeThreshold  float64
+	keyframeInterval time.Duration
+
+	powerCycle *PowerCycle
+	statsMask  *Mask
+	alarm      *alarmState
+	clock      *clockEstimator
+	quality    *QualityGate
+	stuck      *stuckDetector
+
+	resyncPolicy   ResyncPolicy
+	resyncEscalate bool
+
+	segmentJitter bool
+	jitter        jitterState
+	measureTx     int32 // accessed atomically
+
+	statsMu      sync.Mutex
+	stats        Stats
+	rejects      *rejectLog
+	validPackets uint64 // not yet added to stats
+
+	// Packet buffering (see SetPacketBuffer)
+	packetBufSize int
+	bufferPolicy  BufferPolicy
+	spiReadMode   SPIReadMode
+
+	// Set when packets have been dropped or the stream paused, so
+	// NextFrame restarts assembly.
+	streamBreak  int32 // accessed atomically
+	awaitSegment bool
+
+	// captureMu serialises frame capture and CCI commands issued
+	// via WithCCI.
+	captureMu sync.Mutex
 }
 
+// SetLogFunc sets the function called with diagnostic messages. See
+// also SetLogLevel.
 func (d *Lepton3) SetLogFunc(log func(string)) {
 	d.log = log
 }
 
+// TempConverter returns the converter used to turn radiometric pixel
+// values into temperatures. Its fields may be adjusted to suit the
+// scene (e.g. emissivity).
+func (d *Lepton3) TempConverter() *TempConverter {
+	return d.tempConv
+}
+
+// SetCRCCheck enables or disables checking of the CRC included with
+// every packet. Packets with a bad CRC trigger a resync. CRC checking
+// is disabled by default.
+//
+// Enabling CRC checking also disables the zero CRC discard heuristic
+// (see SetZeroCRCDiscard), and disabling it re-enables the
+// heuristic. Call SetZeroCRCDiscard afterwards to override this.
+func (d *Lepton3) SetCRCCheck(enable bool) {
+	d.crcCheck = enable
+	d.zeroCRCDiscard = !enable
+}
+
+// SetZeroCRCDiscard controls whether packet 0 is silently ignored when
+// both of its CRC bytes are zero. This heuristic protects against the
+// all-zero packets seen when the SPI bus isn't being driven, but can
+// also discard a legitimate packet 0 whose CRC happens to be zero.
+//
+// Note that an all-zero packet has a valid CRC, so CRC checking
+// doesn't reject these. With the heuristic disabled, runs of zero
+// packets are instead caught by the frame builder's packet sequence
+// checks.
+func (d *Lepton3) SetZeroCRCDiscard(enable bool) {
+	d.zeroCRCDiscard = enable
+}
+
+// SetSegmentZeroPolicy controls how segments numbered 0 (which the
+// camera uses to flag segments that aren't part of a valid frame) are
+// handled during frame assembly. See SegmentZeroPolicy.
+func (d *Lepton3) SetSegmentZeroPolicy(policy SegmentZeroPolicy) {
+	d.frameBuilder.segmentZero = policy
+}
+
+// SetSegmentRepeatPolicy controls how a segment which repeats the
+// previous segment number is handled during frame assembly. See
+// SegmentRepeatPolicy.
+func (d *Lepton3) SetSegmentRepeatPolicy(policy SegmentRepeatPolicy) {
+	d.frameBuilder.repeat = policy
+}
+
+// SetAssemblyMode controls how packets are assembled into segments.
+// AssemblyTracked tolerates packets which arrive out of order within
+// a segment. See AssemblyMode.
+func (d *Lepton3) SetAssemblyMode(mode AssemblyMode) {
+	d.frameBuilder.mode = mode
+	d.frameBuilder.reset()
+}
+
+// SetWarmupPolicy controls what NextFrame does while the camera is
+// warming up, allowing normal startup to be distinguished from actual
+// errors. See WarmupPolicy.
+func (d *Lepton3) SetWarmupPolicy(policy WarmupPolicy) {
+	d.warmup = policy
+}
+
+// SetStrict enables or disables internal invariant checks during
+// frame assembly. When enabled, impossible states (e.g. a frame
+// growing past its expected size) cause a panic rather than silently
+// producing corrupt frames. This is intended for development and is
+// disabled by default.
+func (d *Lepton3) SetStrict(strict bool) {
+	d.frameBuilder.strict = strict
+}
+
+// SetSkipFFCFrames controls whether NextFrame skips frames which the
+// telemetry flags as being captured while an FFC is running. These
+// frames are frozen or blurred while the shutter is closed. Skipped
+// frames count towards the frame timeout. This is disabled by default.
+func (d *Lepton3) SetSkipFFCFrames(skip bool) {
+	d.skipFFCFrames = skip
+}
+
+// SetStatsOnly enables a headless monitoring mode where NextFrame
+// doesn't output frames at all, saving a pass over every frame. Pixel
+// statistics are still calculated during assembly and are available
+// from LastFrameInfo, and alarms and clock estimation still work.
+// NextFrame's output slice isn't written (so may be nil), and the
+// quality gate, stale frame fallback and RunCapture, which all need
+// the frame, can't be used. This is disabled by default.
+func (d *Lepton3) SetStatsOnly(enable bool) {
+	d.statsOnly = enable
+}
+
+// SetLatestFrame enables a low latency mode for live viewers. After
+// assembling a frame, NextFrame carries on assembling from any packets
+// already buffered and returns the newest frame completed from them,
+// rather than leaving older frames queued for the next call. This
+// minimises display latency at the cost of skipping frames, which
+// shows as gaps in FrameInfo.Sequence. It is disabled by default,
+// which suits recording where no frames should be dropped.
+func (d *Lepton3) SetLatestFrame(enable bool) {
+	d.latestFrame = enable
+}
+
+// SetMaxTransferRate caps the number of SPI transfers per second made
+// while streaming, reducing contention on shared SPI buses or busy
+// CPUs at the cost of less buffering headroom. A rate of 0 removes
+// the cap (the default). Rates too low to keep up with the camera are
+// rejected. Takes effect the next time the camera is opened.
+func (d *Lepton3) SetMaxTransferRate(perSecond int) error {
+	if perSecond == 0 {
+		d.txInterval = 0
+		return nil
+	}
+	if min := minTransferRate(d.packetsPerRead); perSecond < min {
+		return fmt.Errorf("transfer rate must be at least %d per second", min)
+	}
+	d.txInterval = time.Second / time.Duration(perSecond)
+	return nil
+}
+
+// minTransferRate returns the lowest transfer rate which can keep up
+// with the camera when reading the given number of packets per
+// transfer.
+func minTransferRate(packets int) int {
+	return 2 * segmentsPerSecond * packetsPerSegment / packets
+}
+
+// SetTransferSize sets the number of packets read in each SPI
+// transfer (128 by default). Larger transfers are more efficient with
+// native SPI peripherals. USB SPI bridges (such as the FT232H) often
+// time out or fail with large transfers, and are usually more
+// reliable reading 8 to 32 packets at a time. Smaller transfers mean
+// more transfers per second are needed to keep up with the camera, so
+// a transfer rate cap set using SetMaxTransferRate must still be high
+// enough. The camera must not be open.
+func (d *Lepton3) SetTransferSize(packets int) error {
+	if d.IsOpen() {
+		return errors.New("can't change transfer size while the camera is open")
+	}
+	if packets < 1 || packets > maxPacketsPerTransfer {
+		return fmt.Errorf("transfer size must be between 1 and %d packets", maxPacketsPerTransfer)
+	}
+	if d.txInterval > 0 {
+		if min := minTransferRate(packets); int(time.Second/d.txInterval) < min {
+			return fmt.Errorf("transfer rate cap is below the %d per second needed for %d packet transfers", min, packets)
+		}
+	}
+	ring := newTransferRing(packets)
+	if d.packetBufSize > maxPacketBuffer(ring) {
+		return fmt.Errorf("packet buffer size %d is too large for %d packet transfers", d.packetBufSize, packets)
+	}
+	d.ring = ring
+	d.packetsPerRead = packets
+	return nil
+}
+
+// newTransferRing returns a ring buffer for SPI transfers of the given
+// number of packets. The ring buffer is used to avoid memory
+// allocations for SPI transfers. We aim to have it big enough to
+// handle all the SPI transfers for at least a 3 frames.
+func newTransferRing(packets int) *ring {
+	chunks := 3 * int(math.Ceil(float64(maxPacketsPerFrame)/float64(packets)))
+	return newRing(chunks, packets*vospiPacketSize)
+}
+
+// SetTelemetryLayout enables or disables the camera's telemetry
+// output, or moves it between the header and footer, and configures
+// frame assembly to match. Regardless of the layout, the telemetry is
+// always at the start of raw frames, and is zeroed when telemetry is
+// disabled. The camera must not be streaming.
+func (d *Lepton3) SetTelemetryLayout(layout TelemetryLayout) error {
+	if d.cciDev == nil {
+		return errors.New("cant set telemetry layout as cciDev is nil, is the camera open?")
+	}
+	if d.IsOpen() {
+		return errors.New("cant set telemetry layout while streaming")
+	}
+	if layout < TelemetryHeader || layout > TelemetryFooter {
+		return fmt.Errorf("invalid telemetry layout: %d", layout)
+	}
+	if err := d.cciDev.regs.setTelemetryLayout(context.Background(), layout); err != nil {
+		return fmt.Errorf("SetTelemetryLayout: %v", err)
+	}
+	d.frameBuilder.setTelemetryLayout(layout)
+	return nil
+}
+
+// SetStaleOnTimeout enables or disables the stale frame fallback. When
+// enabled, a frame timeout in NextFrame copies the last good frame
+// into the output frame and returns ErrStaleFrame instead of failing
+// outright. This smooths display output during brief link hiccups. It
+// is disabled by default.
+func (d *Lepton3) SetStaleOnTimeout(enable bool) {
+	if !enable {
+		d.lastGoodFrame = nil
+	} else if d.lastGoodFrame == nil {
+		d.lastGoodFrame = NewRawFrame()
+	}
+	d.haveGoodFrame = false
+}
+
+// SetMaxResyncs sets the maximum number of resyncs allowed while
+// reading a single frame. Once exceeded, NextFrame returns
+// ErrTooManyResyncs rather than continuing to resync until the frame
+// timeout. A value of 0 means no limit. The default is 5.
+func (d *Lepton3) SetMaxResyncs(n int) {
+	d.maxResyncs = n
+}
+
 // SetRadiometry enables or disables radiometry mode. If enabled, the
 // camera will attempt to automatically compensate for ambient
 // temperature changes.
@@ -122,7 +507,8 @@ func (d *Lepton3) SetRadiometry(enable bool) error {
 	if err := d.cciDev.SetRadiometry(enable); err != nil {
 		return fmt.Errorf("SetRadiometry: %v", err)
 	}
-	return nil
+	_, err := d.RefreshRadiometric()
+	return err
 }
 
 // GetFFCModeControl returns the parameters and state relating to FFC.
@@ -150,13 +536,188 @@ func (d *Lepton3) SetFFCModeControl(mode *FFCMode) error {
 	return d.cciDev.SetFFCModeControl(mode)
 }
 
+// GetFFCState returns whether an FFC is in progress and how long it
+// has been since the last one. Applications scheduling their own FFCs
+// can use this to avoid triggering them too frequently.
+func (d *Lepton3) GetFFCState() (*FFCState, error) {
+	if d.cciDev == nil {
+		return nil, errors.New("cant get FFC state as cciDev is nil, is the camera open?")
+	}
+	var status FFCStatus
+	if err := d.cciDev.regs.get(context.Background(), sysFFCStatus, &status); err != nil {
+		return nil, fmt.Errorf("GetFFCState: %v", err)
+	}
+	mode, err := d.cciDev.GetFFCModeControl()
+	if err != nil {
+		return nil, fmt.Errorf("GetFFCState: %v", err)
+	}
+	return &FFCState{
+		Status:       status,
+		SinceLastFFC: mode.ElapsedTimeSinceLastFFC,
+	}, nil
+}
+
+// GetSceneStats returns the scene statistics (mean, min, max and
+// pixel count) as calculated by the camera. These may differ slightly
+// from statistics calculated from the output frames.
+func (d *Lepton3) GetSceneStats() (*SceneStats, error) {
+	if d.cciDev == nil {
+		return nil, errors.New("cant get scene stats as cciDev is nil, is the camera open?")
+	}
+	stats := new(SceneStats)
+	if err := d.cciDev.regs.get(context.Background(), sysSceneStats, stats); err != nil {
+		return nil, fmt.Errorf("GetSceneStats: %v", err)
+	}
+	return stats, nil
+}
+
+// GetAGCROI returns the region of the frame used by the camera's
+// internal AGC calculations.
+func (d *Lepton3) GetAGCROI() (image.Rectangle, error) {
+	if d.cciDev == nil {
+		return image.ZR, errors.New("cant get AGC ROI as cciDev is nil, is the camera open?")
+	}
+	var roi cciROI
+	if err := d.cciDev.regs.get(context.Background(), agcROISelect, &roi); err != nil {
+		return image.ZR, fmt.Errorf("GetAGCROI: %v", err)
+	}
+	return roi.rect(), nil
+}
+
+// SetAGCROI restricts the camera's internal AGC calculations to the
+// region r, which must lie within the frame. This only affects the
+// camera's output when its AGC is enabled, which isn't the case for
+// the raw 14-bit output this package configures by default.
+func (d *Lepton3) SetAGCROI(r image.Rectangle) error {
+	if d.cciDev == nil {
+		return errors.New("cant set AGC ROI as cciDev is nil, is the camera open?")
+	}
+	roi, err := roiFromRect(r)
+	if err != nil {
+		return err
+	}
+	if err := d.cciDev.regs.set(context.Background(), agcROISelect, &roi); err != nil {
+		return fmt.Errorf("SetAGCROI: %v", err)
+	}
+	return nil
+}
+
 // RunFFC forces the camera to run a Flat Field Correction
 // recalibration.
 func (d *Lepton3) RunFFC() error {
+	return d.RunFFCContext(context.Background())
+}
+
+// RunFFCContext is like RunFFC but gives up waiting for the camera
+// when ctx is cancelled, returning ctx.Err(). This stops a camera
+// firmware lock-up from blocking the caller indefinitely. The CCI is
+// left idle or still running the command, and later commands wait for
+// it to become idle.
+//
+// RunFFCContext returns once the camera has accepted the command. Use
+// WaitFFC to wait for the FFC to finish.
+func (d *Lepton3) RunFFCContext(ctx context.Context) error {
 	if d.cciDev == nil {
 		return errors.New("cant run FFC as cciDev is nil, is the camera open?")
 	}
-	return d.cciDev.RunFFC()
+	if err := d.cciDev.regs.run(ctx, sysFFCRun); err != nil {
+		return fmt.Errorf("RunFFC: %v", err)
+	}
+	return nil
+}
+
+// WaitFFC waits for any FFC in progress to finish, or until ctx is
+// cancelled, in which case ctx.Err() is returned.
+func (d *Lepton3) WaitFFC(ctx context.Context) error {
+	if d.cciDev == nil {
+		return errors.New("cant wait for FFC as cciDev is nil, is the camera open?")
+	}
+	for {
+		var status FFCStatus
+		if err := d.cciDev.regs.get(ctx, sysFFCStatus, &status); err != nil {
+			return fmt.Errorf("WaitFFC: %v", err)
+		}
+		if !status.InProgress() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ffcPollInterval):
+		}
+	}
+}
+
+// Reboot restarts the camera using the OEM reboot command. This is
+// the cleanest way to recover from firmware lock-ups without cycling
+// power. Camera settings revert to their defaults on reboot, except
+// for the telemetry configuration which is restored (see WaitReady).
+//
+// If the camera is open, the SPI stream is lost while the camera
+// reboots, so Reboot waits for the camera to become ready and then
+// re-establishes streaming. Otherwise Reboot returns as soon as the
+// command is sent and WaitReady can be used to wait for the camera.
+func (d *Lepton3) Reboot() error {
+	if d.cciDev == nil {
+		return errors.New("cant reboot as cciDev is nil, is the camera open?")
+	}
+	wasOpen := d.IsOpen()
+	if wasOpen {
+		d.Close()
+		cciDev, err := openCCI(d.i2cName)
+		if err != nil {
+			return err
+		}
+		d.cciDev = cciDev
+	}
+	if err := d.cciDev.regs.send(context.Background(), oemReboot); err != nil {
+		return fmt.Errorf("Reboot: %v", err)
+	}
+	// The radiometry settings revert to their defaults.
+	d.tlinearKnown = false
+	if !wasOpen {
+		return nil
+	}
+	time.Sleep(rebootSettle)
+	if err := d.WaitReady(rebootTimeout); err != nil {
+		return err
+	}
+	d.frameBuilder.reset()
+	if err := d.open(); err != nil {
+		return err
+	}
+	d.refreshRadiometric()
+	return nil
+}
+
+// WaitReady waits up to timeout for the camera to finish booting (for
+// example after Reboot) and then restores the telemetry configuration
+// this package relies on. It must not be called while the camera is
+// open.
+func (d *Lepton3) WaitReady(timeout time.Duration) error {
+	if d.IsOpen() {
+		return errors.New("cant wait for camera while streaming")
+	}
+	if d.cciDev == nil {
+		cciDev, err := openCCI(d.i2cName)
+		if err != nil {
+			return err
+		}
+		d.cciDev = cciDev
+	}
+	if err := d.cciDev.regs.waitBooted(timeout); err != nil {
+		return err
+	}
+	if err := d.cciDev.Init(); err != nil {
+		return fmt.Errorf("WaitReady: %v", err)
+	}
+	if d.frameBuilder.telemetry != TelemetryHeader {
+		// Init always configures a telemetry header.
+		if err := d.cciDev.regs.setTelemetryLayout(context.Background(), d.frameBuilder.telemetry); err != nil {
+			return fmt.Errorf("WaitReady: %v", err)
+		}
+	}
+	return nil
 }
 
 // Get the camera serial number
@@ -167,26 +728,44 @@ func (d *Lepton3) GetSerial() (uint64, error) {
 	return d.cciDev.GetSerial()
 }
 
-// The OEM part number, which is a kind of configuration id
+// GetPartNum returns the camera's OEM part number, which identifies
+// its configuration (e.g. "500-0726-01").
 func (d *Lepton3) GetPartNum() (string, error) {
-	partNum, err := d.cciDev.GetPartNum()
-	if err != nil {
-		return "", err
+	if d.cciDev == nil {
+		return "", errors.New("cant get part number as cciDev is nil, is the camera open?")
+	}
+	var words [16]uint16
+	if err := d.cciDev.regs.get(context.Background(), oemPartNumber, &words); err != nil {
+		return "", fmt.Errorf("GetPartNum: %v", err)
 	}
-	return string(partNum[:32]), err
+	partNum := cciBytes(words[:])
+	if i := bytes.IndexByte(partNum, 0); i >= 0 {
+		partNum = partNum[:i]
+	}
+	return string(bytes.TrimSpace(partNum)), nil
 }
 
-// The software and dsp revisions, which we can use to try and determine what version of the lepton module we have.
+// GetSoftwareVersion returns the camera's software and DSP revisions,
+// which can be used to determine which version of the Lepton module is
+// fitted.
 func (d *Lepton3) GetSoftwareVersion() (LeptonSoftwareRevision, error) {
-	versionInfo, err := d.cciDev.GetSoftwareVersion()
-	if err != nil {
-		return LeptonSoftwareRevision{}, err
+	if d.cciDev == nil {
+		return LeptonSoftwareRevision{}, errors.New("cant get software version as cciDev is nil, is the camera open?")
+	}
+	var words [4]uint16
+	if err := d.cciDev.regs.get(context.Background(), oemSWRevision, &words); err != nil {
+		return LeptonSoftwareRevision{}, fmt.Errorf("GetSoftwareVersion: %v", err)
 	}
-	buf := &bytes.Buffer{}
-	s := LeptonSoftwareRevision{}
-	_ = binary.Write(buf, binary.BigEndian, versionInfo)
-	_ = binary.Read(buf, binary.BigEndian, &s)
-	return s, err
+	b := cciBytes(words[:])
+	return LeptonSoftwareRevision{
+		Gpp_major: b[0],
+		Gpp_minor: b[1],
+		Gpp_build: b[2],
+		Dsp_major: b[3],
+		Dsp_minor: b[4],
+		Dsp_build: b[5],
+		Reserved:  [2]uint8{b[6], b[7]},
+	}, nil
 }
 
 // Whether or not TLinear is enabled. It is enabled by default on radiometric lepton modules (2.5, 3.5),
@@ -202,13 +781,38 @@ func (d *Lepton3) IsRadioMetricLeptonModel() bool {
 }
 
 // Open initialises the SPI connection and starts streaming packets
-// from the camera.
+// from the camera. Each call starts a new session (see Stats);
+// configuration and lifetime counters are kept from previous sessions,
+// so a Lepton3 can be closed and reopened to resume capture.
 func (d *Lepton3) Open() error {
-	spiPort, err := spireg.Open("")
+	d.startSession()
+	d.frameSeq = 0
+	if err := d.open(); err != nil {
+		return err
+	}
+	d.refreshRadiometric()
+	return nil
+}
+
+// refreshRadiometric calls RefreshRadiometric, logging any error
+// rather than failing. Radiometric will try again when it's next
+// called. This is only done when the camera's configuration may have
+// changed (on Open and after a reboot) rather than on every
+// reconnection, to keep CCI traffic out of resyncs.
+func (d *Lepton3) refreshRadiometric() {
+	if _, err := d.RefreshRadiometric(); err != nil {
+		d.logf(LogWarn, "%v", err)
+	}
+}
+
+// open (re)connects to the camera without starting a new session.
+func (d *Lepton3) open() error {
+	spiPort, err := spireg.Open(d.spiName)
 	if err != nil {
 		return err
 	}
-	spiConn, err := spiPort.Connect(d.spiSpeed, spi.Mode3, 8)
+	speed := d.nextSpeed
+	spiConn, err := spiPort.Connect(speed, spiMode, spiBitsPerWord)
 	if err != nil {
 		spiPort.Close()
 		return err
@@ -216,22 +820,71 @@ func (d *Lepton3) Open() error {
 
 	d.spiPort = spiPort
 	d.spiConn = spiConn
+	d.openSpeed = speed
 
 	if d.cciDev == nil {
-		cciDev, err := openCCI()
+		cciDev, err := openCCI(d.i2cName)
 		if err != nil {
 			return err
 		}
 		d.cciDev = cciDev
 	}
 
-	return d.startStream()
+	if err := d.startStream(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.opened, 1)
+	return nil
+}
+
+// SPIConfig describes the parameters of the SPI connection to the
+// camera.
+type SPIConfig struct {
+	Device      string
+	Speed       int64 // in Hz
+	Mode        spi.Mode
+	BitsPerWord int
+
+	// TransferSize is the number of bytes read in each transfer
+	// (see SetTransferSize).
+	TransferSize int
+
+	// ReadMode is how transfers read from the camera (see
+	// SetSPIReadMode).
+	ReadMode SPIReadMode
+}
+
+// SPIConfig returns the parameters of the current SPI connection to
+// the camera, which is useful for logging and diagnosing
+// misconfiguration. If the camera isn't open, the parameters which
+// will be used by the next Open are returned, with the device name as
+// given to NewWithDevices (empty means the default device).
+func (d *Lepton3) SPIConfig() SPIConfig {
+	cfg := SPIConfig{
+		Device:       d.spiName,
+		Speed:        d.SPISpeed(),
+		Mode:         spiMode,
+		BitsPerWord:  spiBitsPerWord,
+		TransferSize: d.packetsPerRead * vospiPacketSize,
+		ReadMode:     d.spiReadMode,
+	}
+	if s, ok := d.spiPort.(fmt.Stringer); ok && d.IsOpen() {
+		cfg.Device = s.String()
+	}
+	return cfg
+}
+
+// IsOpen returns true if the camera has been opened (streaming may be
+// paused). It is safe to call from any goroutine.
+func (d *Lepton3) IsOpen() bool {
+	return atomic.LoadInt32(&d.opened) == 1
 }
 
 // Close stops streaming of packets from the camera and closes the SPI
 // device connection. It must only be called if streaming was started
 // with Open().
 func (d *Lepton3) Close() {
+	atomic.StoreInt32(&d.opened, 0)
 	d.stopStream()
 
 	if d.spiPort != nil {
@@ -249,31 +902,95 @@ func (d *Lepton3) Close() {
 // slice.
 //
 // The output slice is provided (rather than being created by
-// NextFrame) to minimise memory allocations.
+// NextFrame) to minimise memory allocations. It is owned by the
+// caller, and NextFrame keeps no reference to it, but anything derived
+// from it without copying (such as a RawImage) is only valid until it
+// is next passed to NextFrame.
+// Use CopyFrame to take an independent image.
 //
 // NextFrame should only be called after a successful call to
-// Open(). Although there is some internal buffering of camera
-// packets, NextFrame must be called frequently enough to ensure
-// frames are not lost.
+// Open(), otherwise ErrNotOpen is returned. Although there is some
+// internal buffering of camera packets, NextFrame must be called
+// frequently enough to ensure frames are not lost.
+//
+// When the camera is in automatic FFC mode it periodically performs
+// an FFC, which can briefly interrupt the stream. NextFrame treats a
+// pause in the stream as a break in the frame being assembled and
+// restarts at the next segment rather than resyncing, so a capture
+// loop needs no special handling: the frame being read when the FFC
+// happens just takes longer to arrive. Frames captured during the FFC
+// can be skipped using SetSkipFFCFrames. Only a pause longer than the
+// disconnection window causes ErrCameraDisconnected.
 func (d *Lepton3) NextFrame(outFrame []byte) error {
-	timeout := time.After(frameTimeout)
+	d.captureMu.Lock()
+	defer d.captureMu.Unlock()
+
+	if !d.IsOpen() {
+		return ErrNotOpen
+	}
+	defer d.flushPackets()
+	defer d.releasePacket()
+	if d.tomb == nil {
+		return ErrPaused
+	}
+	timeout := d.startFrameTimer()
 	d.frameBuilder.reset()
+	d.frameInfo.reset()
 
+	var timer phaseTimer
+	if d.frameTiming {
+		timer.start()
+	}
 	var packet []byte
+	var readAt time.Time
+	var latest *FrameInfo // see SetLatestFrame
 	for {
+		if latest != nil && len(d.packetCh) == 0 {
+			// Nothing newer is buffered so return the frame
+			// already output.
+			return d.endLatest(latest)
+		}
+		if d.frameTiming {
+			timer.mark(&d.frameInfo.Timing.Assembling)
+		}
+		d.releasePacket()
 		select {
-		case packet = <-d.packetCh:
+		case rx := <-d.packetCh:
+			if rx.seq != d.rxSeq+1 {
+				// Packets were dropped (see BufferDropOldest).
+				atomic.StoreInt32(&d.streamBreak, 1)
+			}
+			d.rxSeq = rx.seq
+			d.heldPacket = rx
+			packet, readAt = rx.data, rx.readAt
+			d.frameInfo.Packets++
+			if d.frameTiming {
+				timer.mark(&d.frameInfo.Timing.Waiting)
+			}
 		case <-d.tomb.Dying():
-			if err := d.tomb.Err(); err != nil {
+			if err := d.tomb.Err(); err == ErrCameraDisconnected {
+				return err
+			} else if err != nil {
 				return fmt.Errorf("streaming failed: %v", err)
 			}
 			return nil
 		case <-timeout:
-			return errors.New("frame timeout")
+			d.logf(LogWarn, "frame timeout")
+			d.frameInfo.Timeouts++
+			if d.lastGoodFrame != nil && d.haveGoodFrame {
+				copy(outFrame, d.lastGoodFrame)
+				return ErrStaleFrame
+			}
+			return errFrameTimeout
 		}
 
-		packetNum, err := validatePacket(packet)
+		packetNum, err := d.validatePacket(packet)
 		if err != nil {
+			d.frameInfo.BadPackets++
+			d.countBadPacket()
+			if latest != nil {
+				return d.endLatest(latest)
+			}
 			if err := d.resync(err); err != nil {
 				return err
 			}
@@ -281,39 +998,293 @@ func (d *Lepton3) NextFrame(outFrame []byte) error {
 		} else if packetNum < 0 {
 			continue
 		}
+		d.validPackets++
+
+		if atomic.SwapInt32(&d.streamBreak, 0) == 1 {
+			// Packets were dropped (see BufferDropOldest) or
+			// the stream paused, so restart assembly at the
+			// next segment rather than resyncing.
+			d.frameBuilder.reset()
+			d.awaitSegment = true
+		}
+		if d.awaitSegment {
+			if packetNum != 0 {
+				continue
+			}
+			d.awaitSegment = false
+		}
 
 		complete, err := d.frameBuilder.nextPacket(packetNum, packet)
-		if err != nil {
+		if d.segmentJitter && err == nil && d.frameBuilder.endOfSegment {
+			d.markSegment(readAt)
+		}
+		if layoutErr, ok := err.(*TelemetryLayoutError); ok {
+			// Resyncing won't help with this.
+			return layoutErr
+		} else if err != nil {
+			d.frameInfo.BadPackets++
+			d.countBadPacket()
+			if latest != nil {
+				return d.endLatest(latest)
+			}
 			if err := d.resync(err); err != nil {
 				return err
 			}
+		} else if latest == nil && d.warmup == WarmupReport && d.frameBuilder.endOfSegment &&
+			d.frameBuilder.warmingUp() {
+			// Only return at the end of a segment so the next call
+			// starts cleanly.
+			return ErrWarmingUp
 		} else if complete {
-			d.frameBuilder.output(outFrame)
+			if d.skipFFCFrames && d.frameBuilder.telemetry.enabled() &&
+				rawFFCState(d.frameBuilder.telemetryData()) == FFCRunning {
+				// The camera output is frozen or blurred
+				// while the shutter is closed.
+				d.frameBuilder.reset()
+				continue
+			}
+			if d.frameTiming {
+				timer.mark(&d.frameInfo.Timing.Assembling)
+			}
+			if !d.statsOnly {
+				d.frameBuilder.output(outFrame)
+			}
+			if d.frameTiming {
+				timer.mark(&d.frameInfo.Timing.Output)
+			}
+			if d.quality != nil && !d.statsOnly {
+				if err := d.quality.check(outFrame); err != nil {
+					d.countQualityReject()
+					d.frameBuilder.reset()
+					if latest != nil {
+						copy(outFrame, d.latestBuf)
+						return d.endLatest(latest)
+					}
+					if d.quality.Resync {
+						if err := d.resync(err); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+			}
+			d.frameSeq++
+			d.frameInfo.Sequence = d.frameSeq
+			stats, hot, cold := framePixelStats(d.frameBuilder.pixelData(), d.statsMask, d.alarmRegion())
+			d.frameInfo.Stats = stats
+			d.frameInfo.RangeUsed = d.frameInfo.Stats.RangeUsed()
+			d.frameInfo.finish(d.frameBuilder.framePackets())
+			if d.clock != nil && d.frameBuilder.telemetry.enabled() {
+				d.clock.add(d.frameBuilder.telemetryData(), time.Now())
+			}
+			d.checkAlarms(hot, cold)
+			d.countFrame()
+			d.adaptSpeed(d.frameInfo.Resyncs)
+			if d.lastGoodFrame != nil && !d.statsOnly {
+				copy(d.lastGoodFrame, outFrame)
+				d.haveGoodFrame = true
+			}
+			if err := d.checkStuck(); err != nil {
+				return err
+			}
+			if d.latestFrame && len(d.packetCh) > 0 {
+				// Packets for a newer frame may already be
+				// buffered. Keep assembling from them, replacing
+				// this frame if one completes.
+				info := d.frameInfo
+				latest = &info
+				if d.quality != nil && !d.statsOnly {
+					// Keep this frame in case the newer one
+					// is rejected.
+					if d.latestBuf == nil {
+						d.latestBuf = make([]byte, BytesPerFrame)
+					}
+					copy(d.latestBuf, outFrame)
+				}
+				d.frameBuilder.reset()
+				d.frameInfo.reset()
+				continue
+			}
 			return nil
 		}
 	}
 }
 
+// endLatest returns the frame already output by NextFrame when it
+// stops looking for a newer one (see SetLatestFrame). Assembly may have
+// stopped part way through a segment, so the next call waits for the
+// start of a segment.
+func (d *Lepton3) endLatest(info *FrameInfo) error {
+	d.frameInfo = *info
+	d.awaitSegment = true
+	return nil
+}
+
+// releasePacket hands the packet NextFrame has finished processing
+// back to the streaming goroutine (see sendPacket).
+func (d *Lepton3) releasePacket() {
+	d.heldPacket.release()
+	d.heldPacket = rxPacket{}
+}
+
+// startFrameTimer returns a channel which receives once frameTimeout
+// has elapsed. A single timer is reused to avoid allocating on every
+// call to NextFrame.
+func (d *Lepton3) startFrameTimer() <-chan time.Time {
+	if d.frameTimer == nil {
+		d.frameTimer = time.NewTimer(frameTimeout)
+		return d.frameTimer.C
+	}
+	if !d.frameTimer.Stop() {
+		select {
+		case <-d.frameTimer.C:
+		default:
+		}
+	}
+	d.frameTimer.Reset(frameTimeout)
+	return d.frameTimer.C
+}
+
+// Flush discards any packets which have been buffered but not yet
+// consumed by NextFrame and resets frame assembly, so that the next
+// call to NextFrame starts cleanly rather than part way through a
+// stale frame. This is useful when frames are read intermittently.
+// It is safe to call at any time, including when the camera isn't
+// open.
+func (d *Lepton3) Flush() {
+	for {
+		select {
+		case rx := <-d.packetCh:
+			rx.release()
+		default:
+			d.frameBuilder.reset()
+			return
+		}
+	}
+}
+
+// Pause stops streaming packets from the camera but leaves the SPI
+// port open, which is cheaper than a full Close and Open for
+// intermittent capture. Calling Pause when already paused has no
+// effect. NextFrame returns ErrPaused while paused.
+func (d *Lepton3) Pause() {
+	d.stopStream()
+}
+
+// Resume restarts streaming after Pause. Stale packets are discarded
+// and frame assembly is reset so that the next frame starts
+// cleanly. Calling Resume when not paused has no effect.
+func (d *Lepton3) Resume() error {
+	if !d.IsOpen() {
+		return errors.New("can't resume as camera isn't open")
+	}
+	if d.tomb != nil {
+		return nil
+	}
+	d.Flush()
+	return d.startStream()
+}
+
+// WithCCI runs fn, which would typically issue CCI commands such as
+// RunFFC or SetFFCModeControl, without interfering with frame
+// capture. It waits for any in-progress NextFrame call to complete,
+// pauses streaming while fn runs, then resumes streaming with stale
+// packets discarded. This avoids glitched frames and races when
+// control and capture happen on different goroutines.
+//
+// fn must not call NextFrame or WithCCI.
+func (d *Lepton3) WithCCI(fn func() error) error {
+	d.captureMu.Lock()
+	defer d.captureMu.Unlock()
+
+	streaming := d.tomb != nil
+	if streaming {
+		d.Pause()
+	}
+	err := fn()
+	if streaming {
+		if resumeErr := d.Resume(); resumeErr != nil && err == nil {
+			err = resumeErr
+		}
+	}
+	return err
+}
+
 // Snapshot is convenience method for capturing a single frame. It
 // should *not* be called if streaming is already active.
+//
+// Afterwards, LastFrameInfo describes the recovery work needed to
+// capture the snapshot, even if it failed (see SnapshotWithInfo).
 func (d *Lepton3) Snapshot() ([]byte, error) {
+	frame, _, err := d.SnapshotWithInfo()
+	return frame, err
+}
+
+// SnapshotWithInfo is like Snapshot but also returns the FrameInfo
+// describing the recovery work needed to capture the snapshot, even
+// if it failed. For example, a health probe can check
+// FrameInfo.Resyncs, Timeouts and BadPackets to judge the quality of
+// the link to the camera: a clean snapshot has none of them.
+//
+// A frame timeout is recovered from by resyncing and trying again, up
+// to snapshotTimeoutRetries times. The counts in the FrameInfo cover
+// every attempt.
+func (d *Lepton3) SnapshotWithInfo() ([]byte, FrameInfo, error) {
+	if d.IsOpen() {
+		return nil, FrameInfo{}, errors.New("can't snapshot while streaming is active")
+	}
+	d.frameInfo.reset()
 	if err := d.Open(); err != nil {
-		return nil, err
+		return nil, d.frameInfo, err
 	}
 	defer d.Close()
 	frame := NewRawFrame()
-	if err := d.NextFrame(frame); err != nil {
-		return nil, err
+	var earlier FrameInfo // counts from attempts which timed out
+	for {
+		err := d.NextFrame(frame)
+		if err == errFrameTimeout && earlier.Timeouts < snapshotTimeoutRetries {
+			// resync counts itself in d.frameInfo.
+			err = d.resync(err)
+			earlier.addCounts(&d.frameInfo)
+			if err == nil {
+				continue
+			}
+			d.frameInfo = earlier
+			return nil, d.frameInfo, err
+		}
+		d.frameInfo.addCounts(&earlier)
+		if err != nil {
+			return nil, d.frameInfo, err
+		}
+		d.frameInfo.finish(d.frameBuilder.framePackets())
+		return frame, d.frameInfo, nil
 	}
-	return frame, nil
 }
 
 func (d *Lepton3) resync(reason error) error {
-	d.log(fmt.Sprintf("resync! %v", reason))
+	if d.maxResyncs > 0 && d.frameInfo.Resyncs >= d.maxResyncs {
+		d.adaptSpeed(d.frameInfo.Resyncs)
+		return ErrTooManyResyncs
+	}
+	strategy := d.resyncStrategy(d.frameInfo.Resyncs)
+	if d.nextSpeed != d.openSpeed {
+		// Only reopening changes the SPI speed (see AdaptiveSpeed).
+		strategy = ResyncReopen
+	}
+	d.logf(LogWarn, "resync! %v", reason)
+	d.frameInfo.Resyncs++
+	d.countResync()
+	switch strategy {
+	case ResyncDrain:
+		d.drainPackets()
+		return nil
+	case ResyncRestartStream:
+		return d.restartStream()
+	}
 	d.Close()
 	d.frameBuilder.reset()
-	time.Sleep(300 * time.Millisecond)
-	return d.Open()
+	time.Sleep(resyncPause)
+	return d.open()
 }
 
 func (d *Lepton3) startStream() error {
@@ -321,30 +1292,115 @@ func (d *Lepton3) startStream() error {
 		return errors.New("streaming already active")
 	}
 	d.tomb = new(tomb.Tomb)
-	d.packetCh = make(chan []byte, packetChSize)
+	bufSize := d.packetBufSize
+	if bufSize == 0 {
+		bufSize = packetChSize
+	}
+	d.packetCh = make(chan rxPacket, bufSize)
+	d.freePackets = nil
+	if d.bufferPolicy == BufferDropOldest {
+		d.freePackets = newPacketSlots(bufSize + 1)
+	}
+	atomic.StoreInt32(&d.streamBreak, 0)
+	d.rxSeq = 0
+	// Don't measure segment intervals across restarts.
+	d.jitter.last = time.Time{}
+	txInterval := d.txInterval
+	policy := d.bufferPolicy
+	read := d.spiReader()
 	d.tomb.Go(func() error {
+		lastUsable := time.Now()
+		var lastTx time.Time
+		var rx []byte
+		var seq uint32
+		sent := true
 		for {
-			rx := d.ring.next()
-			if err := d.spiConn.Tx(nil, rx); err != nil {
+			// Check for shutdown before every transfer. If the
+			// camera is only producing discard packets nothing is
+			// sent on packetCh below, so this is the only place
+			// the goroutine would notice that it's been asked to
+			// stop.
+			select {
+			case <-d.tomb.Dying():
+				return tomb.ErrDying
+			default:
+			}
+
+			if txInterval > 0 {
+				if wait := txInterval - time.Since(lastTx); wait > 0 {
+					select {
+					case <-d.tomb.Dying():
+						return tomb.ErrDying
+					case <-time.After(wait):
+					}
+				}
+				lastTx = time.Now()
+			}
+
+			// Only move on to the next chunk once packets from this
+			// one have been sent. While the camera is only producing
+			// discard packets (e.g. during an FFC) the same chunk is
+			// reused so the ring can't wrap around onto packets that
+			// are still waiting in packetCh.
+			if sent {
+				rx = d.ring.next()
+				sent = false
+			}
+			measure := atomic.LoadInt32(&d.measureTx) == 1
+			var txStart time.Time
+			if measure {
+				txStart = time.Now()
+			}
+			if err := read(rx); err != nil {
+				// A transfer failing because the stream is being
+				// shut down is a clean stop, not a fault.
+				select {
+				case <-d.tomb.Dying():
+					return tomb.ErrDying
+				default:
+				}
 				return err
 			}
+			readAt := time.Now()
+			if measure {
+				d.countTxLatency(readAt.Sub(txStart))
+			}
+			d.countTransfer(len(rx))
+			usable := false
 			for i := 0; i < len(rx); i += vospiPacketSize {
 				if rx[i]&packetHeaderDiscard == packetHeaderDiscard {
 					// No point sending discard packets onwards.
 					// This makes a big difference to CPU utilisation.
 					continue
 				}
-				select {
-				case <-d.tomb.Dying():
-					return tomb.ErrDying
-				case d.packetCh <- rx[i : i+vospiPacketSize]:
+				if !usable && !isZeroHeader(rx[i:]) {
+					usable = true
+					if time.Since(lastUsable) > streamPauseThreshold {
+						atomic.StoreInt32(&d.streamBreak, 1)
+					}
+				}
+				seq++
+				packet := rxPacket{data: rx[i : i+vospiPacketSize], readAt: readAt, seq: seq}
+				if err := d.sendPacket(packet, policy); err != nil {
+					return err
 				}
+				sent = true
+			}
+
+			if usable {
+				lastUsable = time.Now()
+			} else if time.Since(lastUsable) > disconnectWindow {
+				return ErrCameraDisconnected
 			}
 		}
 	})
 	return nil
 }
 
+// stopStream stops the streaming goroutine and waits for it to
+// exit. The goroutine checks for shutdown between SPI transfers and
+// while blocked sending packets so this returns within one transfer
+// even if NextFrame is no longer being called.
 func (d *Lepton3) stopStream() {
 	if d.tomb != nil {
 		d.tomb.Kill(nil)
@@ -353,7 +1409,30 @@ func (d *Lepton3) stopStream() {
 	}
 }
 
-func validatePacket(packet []byte) (int, error) {
+// validatePacket checks the header (and optionally the CRC) of a
+// packet, returning the packet number. A packet number of -1 with a
+// nil error means the packet should be ignored.
+func (d *Lepton3) validatePacket(packet []byte) (int, error) {
+	packetNum, err := checkPacket(packet, d.crcCheck, d.zeroCRCDiscard)
+	if err != nil {
+		if _, ok := err.(*crcError); ok {
+			d.frameInfo.CRCErrors++
+			d.countCRCError(d.frameBuilder.currentSegment())
+		}
+		d.recordReject(packet)
+		if d.logEnabled(LogDebug) {
+			d.logf(LogDebug, "rejected packet %x: %v", packet[:vospiHeaderSize], err)
+		}
+	}
+	return packetNum, err
+}
+
+// checkPacket implements packet validation for validatePacket and
+// Decoder. It runs for every packet so is kept simple. Discard packets
+// are filtered out by the callers before getting here. Combining the
+// header bit and packet number checks into a single comparison was
+// measured to be slower than the separate, well predicted branches.
+func checkPacket(packet []byte, crcCheck, zeroCRCDiscard bool) (int, error) {
 	header := binary.BigEndian.Uint16(packet)
 	if header&0x8000 == 0x8000 {
 		return -1, errors.New("first bit set on header")
@@ -364,18 +1443,33 @@ func validatePacket(packet []byte) (int, error) {
 		return -1, errors.New("invalid packet number")
 	}
 
-	// XXX might not necessary with CRC check
-	if packetNum == 0 && packet[2] == 0 && packet[3] == 0 {
+	if zeroCRCDiscard && packetNum == 0 && packet[2] == 0 && packet[3] == 0 {
 		return -1, nil
 	}
 
-	// XXX CRC checks
+	if crcCheck {
+		if crc := binary.BigEndian.Uint16(packet[2:]); crc != packetCRC(packet) {
+			return -1, &crcError{packetNum}
+		}
+	}
 
 	return packetNum, nil
 }
 
-func openCCI() (*closingCCIDev, error) {
-	i2cBus, err := i2creg.Open("")
+type crcError struct {
+	packetNum int
+}
+
+func (e *crcError) Error() string {
+	return fmt.Sprintf("CRC mismatch on packet %d", e.packetNum)
+}
+
+func isZeroHeader(packet []byte) bool {
+	return packet[0] == 0 && packet[1] == 0 && packet[2] == 0 && packet[3] == 0
+}
+
+func openCCI(i2cName string) (*closingCCIDev, error) {
+	i2cBus, err := i2creg.Open(i2cName)
 	if err != nil {
 		return nil, err
 	}
@@ -388,10 +1482,12 @@ func openCCI() (*closingCCIDev, error) {
 	return &closingCCIDev{
 		Dev:    cciDev,
 		Closer: i2cBus,
+		regs:   newCCIConn(i2cBus),
 	}, nil
 }
 
 type closingCCIDev struct {
 	*cci.Dev
 	io.Closer
+	regs *cciConn
 }
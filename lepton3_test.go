@@ -0,0 +1,633 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+func BenchmarkCheckPacket(b *testing.B) {
+	packet := testPacket(10, 0, 0x55)
+	for i := 0; i < b.N; i++ {
+		if _, err := checkPacket(packet, false, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCheckPacketCRC(b *testing.B) {
+	packet := testPacket(10, 0, 0x55)
+	for i := 0; i < b.N; i++ {
+		if _, err := checkPacket(packet, true, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidatePacket(b *testing.B) {
+	d := &Lepton3{frameBuilder: newFrameBuilder(), log: func(string) {}}
+	packet := testPacket(10, 0, 0x55)
+	for i := 0; i < b.N; i++ {
+		if _, err := d.validatePacket(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkNextFrame measures the whole packet path, from SPI
+// transfers through to the assembled frame, using a fake camera which
+// sends frames as fast as they are read.
+func BenchmarkNextFrame(b *testing.B) {
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	d, cleanup := newTestCamera(b, spiConn, nil)
+	defer cleanup()
+	if err := d.Open(); err != nil {
+		b.Fatal(err)
+	}
+	raw := NewRawFrame()
+	b.SetBytes(BytesPerFrame)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.NextFrame(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNextFrameAllocs(t *testing.T) {
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	raw := NewRawFrame()
+	allocs := testing.AllocsPerRun(50, func() {
+		if err := d.NextFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("NextFrame made %v allocations per frame, want 0", allocs)
+	}
+}
+
+func TestParseRawFrameAllocs(t *testing.T) {
+	d := &Lepton3{}
+	raw := NewRawFrame()
+	frame := cptvframe.NewFrame(d)
+	allocs := testing.AllocsPerRun(50, func() {
+		if err := ParseRawFrame(raw, frame); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("ParseRawFrame made %v allocations per frame, want 0", allocs)
+	}
+}
+
+func TestValidatePacketCRCOptions(t *testing.T) {
+	const (
+		accepted = iota
+		ignored
+		crcErr
+	)
+	badCRC := func(packet []byte) []byte {
+		packet[3]++
+		return packet
+	}
+	zeroCRC := func(packet []byte) []byte {
+		packet[2], packet[3] = 0, 0
+		return packet
+	}
+	packets := []struct {
+		name   string
+		packet []byte
+		num    int
+	}{
+		{"good", testPacket(5, 0, 0x55), 5},
+		{"good packet 0", testPacket(0, 0, 0x55), 0},
+		{"bad CRC", badCRC(testPacket(7, 0, 0x55)), 7},
+		{"packet 0 zero CRC bytes", zeroCRC(testPacket(0, 0, 0x55)), 0},
+		// All zero, which has a valid CRC of 0.
+		{"packet 0 all zero", make([]byte, vospiPacketSize), 0},
+	}
+	tests := []struct {
+		crcCheck    bool
+		zeroDiscard bool
+		want        []int // result for each packet
+	}{
+		{false, false, []int{accepted, accepted, accepted, accepted, accepted}},
+		{false, true, []int{accepted, accepted, accepted, ignored, ignored}},
+		{true, false, []int{accepted, accepted, crcErr, crcErr, accepted}},
+		{true, true, []int{accepted, accepted, crcErr, ignored, ignored}},
+	}
+	for _, tt := range tests {
+		d := &Lepton3{frameBuilder: newFrameBuilder(), log: func(string) {}}
+		d.SetCRCCheck(tt.crcCheck)
+		d.SetZeroCRCDiscard(tt.zeroDiscard)
+		for i, p := range packets {
+			num, err := d.validatePacket(p.packet)
+			got := accepted
+			if _, ok := err.(*crcError); ok {
+				got = crcErr
+			} else if err != nil {
+				t.Errorf("crc=%v discard=%v %s: unexpected error: %v", tt.crcCheck, tt.zeroDiscard, p.name, err)
+				continue
+			} else if num < 0 {
+				got = ignored
+			} else if num != p.num {
+				t.Errorf("crc=%v discard=%v %s: got packet number %d, want %d",
+					tt.crcCheck, tt.zeroDiscard, p.name, num, p.num)
+			}
+			if got != tt.want[i] {
+				t.Errorf("crc=%v discard=%v %s: got result %d, want %d",
+					tt.crcCheck, tt.zeroDiscard, p.name, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSetCRCCheckDefaultsZeroCRCDiscard(t *testing.T) {
+	d := &Lepton3{}
+	d.SetCRCCheck(true)
+	if d.zeroCRCDiscard {
+		t.Error("enabling CRC checking should disable zero CRC discard")
+	}
+	d.SetCRCCheck(false)
+	if !d.zeroCRCDiscard {
+		t.Error("disabling CRC checking should enable zero CRC discard")
+	}
+}
+
+func TestNextFrameWarmup(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  WarmupPolicy
+		zeros   int // segments numbered 0 before the frame
+		reports bool
+	}{
+		{"wait", WarmupWait, 2 * warmupFrames * segmentsPerFrame, false},
+		{"report", WarmupReport, 2 * warmupFrames * segmentsPerFrame, true},
+		// The camera sends 2 frames of segment 0 between valid
+		// frames in normal operation.
+		{"report between frames", WarmupReport, 2 * segmentsPerFrame, false},
+	}
+	for _, tt := range tests {
+		spiConn := new(fakeSPI)
+		for i := 0; i < tt.zeros; i++ {
+			spiConn.send(testSegment(TelemetryHeader, 0, 0xa5)...)
+		}
+		spiConn.send(testFrame(TelemetryHeader, 1)...)
+		d, cleanup := newTestCamera(t, spiConn, nil)
+		d.SetWarmupPolicy(tt.policy)
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		raw := NewRawFrame()
+		reports := 0
+		for {
+			err := d.NextFrame(raw)
+			if err == ErrWarmingUp && reports < tt.zeros {
+				reports++
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			break
+		}
+		if raw[0] != 1 {
+			t.Errorf("%s: unexpected frame data %d", tt.name, raw[0])
+		}
+		if (reports > 0) != tt.reports {
+			t.Errorf("%s: ErrWarmingUp returned %d times", tt.name, reports)
+		}
+		cleanup()
+	}
+}
+
+func TestNextFrameSegmentRepeatNoResync(t *testing.T) {
+	spiConn := new(fakeSPI)
+	spiConn.send(concatPackets(
+		testSegment(TelemetryHeader, 1, 1),
+		testSegment(TelemetryHeader, 2, 2),
+		testSegment(TelemetryHeader, 2, 22),
+		testSegment(TelemetryHeader, 3, 3),
+		testSegment(TelemetryHeader, 4, 4),
+	)...)
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	raw := NewRawFrame()
+	if err := d.NextFrame(raw); err != nil {
+		t.Fatal(err)
+	}
+	if got := raw[packetsPerSegment*vospiDataSize]; got != 22 {
+		t.Errorf("segment 2 = %d, want the retry (22)", got)
+	}
+	if n := d.Stats().Resyncs; n != 0 {
+		t.Errorf("%d resyncs", n)
+	}
+}
+
+// closeWithin calls d.Close, failing the test if it doesn't return
+// within timeout.
+func closeWithin(t *testing.T, d *Lepton3, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		d.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Close didn't return")
+	}
+}
+
+func TestCloseWhileNotReading(t *testing.T) {
+	tests := []struct {
+		name    string
+		spiConn *fakeSPI
+	}{
+		// The streaming goroutine ends up blocked sending to the
+		// full packet buffer.
+		{"packet buffer full", &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}},
+		// Nothing is sent to the packet buffer.
+		{"discards only", new(fakeSPI)},
+	}
+	for _, tt := range tests {
+		d, cleanup := newTestCamera(t, tt.spiConn, nil)
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		// Let the stream run without NextFrame being called.
+		running := func() bool {
+			if len(tt.spiConn.repeat) > 0 {
+				return len(d.packetCh) == cap(d.packetCh)
+			}
+			return atomic.LoadInt32(&tt.spiConn.transfers) >= 10
+		}
+		deadline := time.Now().Add(time.Second)
+		for !running() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: stream didn't start", tt.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		start := time.Now()
+		closeWithin(t, d, time.Second)
+		if took := time.Since(start); took > 100*time.Millisecond {
+			t.Errorf("%s: Close took %v", tt.name, took)
+		}
+		cleanup()
+	}
+}
+
+func TestCloseDuringTx(t *testing.T) {
+	spiConn := &fakeSPI{
+		entered: make(chan struct{}, 1),
+		block:   make(chan error),
+	}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	var log testLog
+	d.SetLogFunc(log.log)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-spiConn.entered:
+	case <-time.After(time.Second):
+		t.Fatal("no transfer started")
+	}
+
+	tb := d.tomb
+	done := make(chan struct{})
+	go func() {
+		d.Close()
+		close(done)
+	}()
+	// Once Close has asked the stream to stop, fail the transfer in
+	// flight as a driver does when the bus is closed under it.
+	select {
+	case <-tb.Dying():
+	case <-time.After(time.Second):
+		t.Fatal("stream not stopped")
+	}
+	spiConn.block <- errors.New("bus closed")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't return")
+	}
+	if err := tb.Err(); err != nil {
+		t.Errorf("stream stopped with error: %v", err)
+	}
+	if n := log.count(""); n != 0 {
+		t.Errorf("unexpected log messages: %q", log.lines)
+	}
+	if d.IsOpen() {
+		t.Error("camera still open")
+	}
+}
+
+func TestNextFrameNotOpen(t *testing.T) {
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	raw := NewRawFrame()
+
+	nextFrame := func(when string) error {
+		errc := make(chan error, 1)
+		go func() { errc <- d.NextFrame(raw) }()
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(time.Second):
+			t.Fatalf("%s: NextFrame blocked", when)
+		}
+		return nil
+	}
+
+	if err := nextFrame("before Open"); err != ErrNotOpen {
+		t.Errorf("before Open: got %v, want ErrNotOpen", err)
+	}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := nextFrame("while open"); err != nil {
+		t.Errorf("while open: %v", err)
+	}
+	d.Close()
+	if err := nextFrame("after Close"); err != ErrNotOpen {
+		t.Errorf("after Close: got %v, want ErrNotOpen", err)
+	}
+}
+
+func TestNextFrameFFCPause(t *testing.T) {
+	tests := []struct {
+		name   string
+		before [][]byte // sent before the pause
+	}{
+		{"between segments", concatPackets(
+			testSegment(TelemetryHeader, 1, 9),
+			testSegment(TelemetryHeader, 2, 9),
+		)},
+		{"mid segment", concatPackets(
+			testSegment(TelemetryHeader, 1, 9),
+			testSegment(TelemetryHeader, 2, 9)[:30],
+		)},
+	}
+	for _, tt := range tests {
+		spiConn := new(fakeSPI)
+		spiConn.send(tt.before...)
+		spiConn.send(nil)
+		spiConn.send(testFrame(TelemetryHeader, 1)...)
+		d, cleanup := newTestCamera(t, spiConn, nil)
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		raw := NewRawFrame()
+		if err := d.NextFrame(raw); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if raw[0] != 1 {
+			t.Errorf("%s: got frame data %d, want the frame after the pause", tt.name, raw[0])
+		}
+		stats := d.Stats()
+		if stats.Resyncs != 0 || stats.BadPackets != 0 {
+			t.Errorf("%s: %d resyncs and %d bad packets, want none", tt.name, stats.Resyncs, stats.BadPackets)
+		}
+		cleanup()
+	}
+}
+
+func TestNextFramePauseWhileNotReading(t *testing.T) {
+	// Packets still buffered when the camera pauses mustn't be
+	// overwritten by the discard-only transfers made during the pause.
+	spiConn := new(fakeSPI)
+	spiConn.send(testFrame(TelemetryHeader, 1)...)
+	spiConn.send(nil)
+	spiConn.send(testFrame(TelemetryHeader, 5)...)
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(fakeSPIPause / 2)
+	raw := NewRawFrame()
+	for _, want := range []byte{1, 5} {
+		if err := d.NextFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] != want {
+			t.Errorf("got frame data %d, want %d", raw[0], want)
+		}
+	}
+	stats := d.Stats()
+	if stats.Resyncs != 0 || stats.BadPackets != 0 {
+		t.Errorf("%d resyncs and %d bad packets, want none", stats.Resyncs, stats.BadPackets)
+	}
+}
+
+func TestNextFrameDropOldestKeepsPackets(t *testing.T) {
+	// Send frames with different contents, so that buffered packets
+	// being overwritten by later transfers would be noticed.
+	var packets [][]byte
+	for fill := byte(0x10); fill < 0x80; fill += 0x10 {
+		packets = append(packets, testFrame(TelemetryHeader, fill)...)
+	}
+	spiConn := &fakeSPI{repeat: packets}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	// Limit the fake camera to about 60 frames a second so that
+	// NextFrame keeps up while it's reading.
+	if err := d.SetTransferSize(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetMaxTransferRate(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetPacketBuffer(packetsPerSegment, BufferDropOldest); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := NewRawFrame()
+	segmentBytes := packetsPerSegment * vospiDataSize
+	for i := 0; i < 20; i++ {
+		if err := d.NextFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+		for seg := 0; seg < segmentsPerFrame; seg++ {
+			data := raw[seg*segmentBytes : (seg+1)*segmentBytes]
+			for _, b := range data {
+				if b != data[0] || int(b&0x0f) != seg {
+					t.Fatalf("frame %d segment %d has packets from another segment", i, seg+1)
+				}
+			}
+		}
+		// Fall behind the camera so that packets are dropped.
+		time.Sleep(20 * time.Millisecond)
+	}
+	if d.Stats().DroppedPackets == 0 {
+		t.Error("no packets were dropped")
+	}
+}
+
+func TestLastFrameInfoPacketCounts(t *testing.T) {
+	for _, layout := range []TelemetryLayout{TelemetryHeader, TelemetryDisabled, TelemetryFooter} {
+		segPackets := len(testSegment(layout, 1, 0))
+		spiConn := new(fakeSPI)
+		// A segment 0 before the frame is read but not used.
+		spiConn.send(testSegment(layout, 0, 0xa5)...)
+		spiConn.send(testFrame(layout, 1)...)
+		d, cleanup := newTestCamera(t, spiConn, nil)
+		if err := d.SetTelemetryLayout(layout); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.NextFrame(NewRawFrame()); err != nil {
+			t.Fatalf("layout %d: %v", layout, err)
+		}
+		info := d.LastFrameInfo()
+		if want := 5 * segPackets; info.Packets != want {
+			t.Errorf("layout %d: got %d packets, want %d", layout, info.Packets, want)
+		}
+		if info.DiscardedPackets != segPackets {
+			t.Errorf("layout %d: got %d discarded packets, want %d", layout, info.DiscardedPackets, segPackets)
+		}
+		if info.Integrity != 1 {
+			t.Errorf("layout %d: got integrity %v, want 1", layout, info.Integrity)
+		}
+		cleanup()
+	}
+}
+
+func TestSnapshotWithInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		clean   bool
+	}{
+		{"clean", testFrame(TelemetryHeader, 1), true},
+		{"bad packet", concatPackets(
+			[][]byte{testPacket(maxPacketNum+1, 0, 0)},
+			testFrame(TelemetryHeader, 1),
+		), false},
+	}
+	for _, tt := range tests {
+		// Frames keep coming after the resync.
+		spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+		spiConn.send(tt.packets...)
+		d, cleanup := newTestCamera(t, spiConn, nil)
+		raw, info, err := d.SnapshotWithInfo()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if raw[0] != 1 {
+			t.Errorf("%s: got frame data %d, want 1", tt.name, raw[0])
+		}
+		clean := info.Resyncs == 0 && info.BadPackets == 0
+		if clean != tt.clean {
+			t.Errorf("%s: got %d resyncs and %d bad packets", tt.name, info.Resyncs, info.BadPackets)
+		}
+		if info != d.LastFrameInfo() {
+			t.Errorf("%s: info doesn't match LastFrameInfo", tt.name)
+		}
+		if d.IsOpen() {
+			t.Errorf("%s: camera left open", tt.name)
+		}
+		cleanup()
+	}
+}
+
+func TestSnapshotWithInfoTimeouts(t *testing.T) {
+	defer func(timeout time.Duration) { frameTimeout = timeout }(frameTimeout)
+	frameTimeout = fakeSPIPause * 2 / 3
+
+	// The camera pauses for longer than the frame timeout, so the
+	// snapshot only succeeds after a resync.
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	spiConn.send(nil)
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	raw, info, err := d.SnapshotWithInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[0] != 1 {
+		t.Errorf("got frame data %d, want 1", raw[0])
+	}
+	if info.Timeouts != 1 || info.Resyncs != 1 {
+		t.Errorf("got %d timeouts and %d resyncs, want 1 of each", info.Timeouts, info.Resyncs)
+	}
+	cleanup()
+
+	// No frames at all.
+	d, cleanup = newTestCamera(t, new(fakeSPI), nil)
+	defer cleanup()
+	_, info, err = d.SnapshotWithInfo()
+	if err != errFrameTimeout {
+		t.Errorf("got %v, want a frame timeout", err)
+	}
+	if info.Timeouts != snapshotTimeoutRetries+1 || info.Resyncs != snapshotTimeoutRetries {
+		t.Errorf("got %d timeouts and %d resyncs", info.Timeouts, info.Resyncs)
+	}
+	if info != d.LastFrameInfo() {
+		t.Error("info doesn't match LastFrameInfo")
+	}
+}
+
+func TestAdaptiveSpeedAppliedOnDrainResync(t *testing.T) {
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	d, cleanup := newTestCamera(t, spiConn, nil)
+	defer cleanup()
+	if err := d.SetResyncPolicy(ResyncDrain, false); err != nil {
+		t.Fatal(err)
+	}
+	err := d.SetAdaptiveSpeed(&AdaptiveSpeed{MinSpeed: minSPISpeed, Window: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame which needed a resync steps the speed down.
+	d.adaptSpeed(1)
+	want := int64(testSPISpeed * speedStepDown)
+	if err := d.resync(errors.New("test")); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.SPISpeed(); got != want {
+		t.Errorf("SPI speed after resync = %d, want %d", got, want)
+	}
+	if n := atomic.LoadInt32(&spiConn.connects); n != 2 {
+		t.Errorf("SPI connected %d times, want 2", n)
+	}
+
+	// Once the speed is applied, resyncs follow the policy again.
+	if err := d.resync(errors.New("test")); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&spiConn.connects); n != 2 {
+		t.Errorf("SPI connected %d times after draining, want 2", n)
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"image"
 	"image/color"
 	"image/png"
@@ -16,7 +17,19 @@ import (
 	"github.com/TheCacophonyProject/lepton3"
 )
 
-func dumpToPNG(path string, frame *cptvframe.Frame) error {
+func agcByName(name string) (lepton3.AGC, error) {
+	switch name {
+	case "minmax":
+		return lepton3.MinMaxAGC{}, nil
+	case "percentile":
+		return lepton3.NewPercentileAGC(1, 99), nil
+	case "histeq":
+		return new(lepton3.HistEqAGC), nil
+	}
+	return nil, fmt.Errorf("invalid AGC: %q", name)
+}
+
+func dumpToPNG(path string, frame *cptvframe.Frame, agc lepton3.AGC) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -26,9 +39,19 @@ func dumpToPNG(path string, frame *cptvframe.Frame) error {
 		w.Flush()
 		f.Close()
 	}()
+	if agc != nil {
+		lepton3.ToGray16(frame, gray16)
+		agc.Apply(gray16, gray)
+		return png.Encode(w, gray)
+	}
 	return png.Encode(w, reduce(frame))
 }
 
+var (
+	gray16 = lepton3.NewGray16()
+	gray   = image.NewGray(gray16.Bounds())
+)
+
 var dst = image.NewGray16(image.Rect(0, 0, lepton3.FrameCols, lepton3.FrameRows))
 
 func reduce(src *cptvframe.Frame) *image.Gray16 {
@@ -25,20 +25,28 @@ import (
 type Options struct {
 	Frames    int    `arg:"-f,help:number of frames to collect (default=all)"`
 	Speed     int64  `arg:"-s,help:SPI speed in MHz"`
+	CS        int    `arg:"-c,help:SPI chip select line on bus 0 (default=system default)"`
 	Directory string `arg:"-d,help:Directory to write output files"`
 	PowerPin  string `arg:"-p,help:Optional pin to set to power on camera"`
 	Verbose   bool   `arg:"-v,help:Verbose output"`
+	AGC       string `arg:"-a,help:AGC for 8-bit PNG output: minmax, percentile or histeq (default=16-bit output)"`
 	Output    string `arg:"positional,required,help:png or none"`
 }
 
 func procCommandLine() Options {
 	opts := Options{}
 	opts.Speed = 30
+	opts.CS = -1
 	opts.Directory = "."
 	arg.MustParse(&opts)
 	if opts.Output != "png" && opts.Output != "none" {
 		log.Fatalf("invalid output type: %q", opts.Output)
 	}
+	if opts.AGC != "" {
+		if _, err := agcByName(opts.AGC); err != nil {
+			log.Fatal(err)
+		}
+	}
 	opts.Speed *= 1000000 // convert to Hz
 	return opts
 }
@@ -68,7 +76,14 @@ func runMain() error {
 		}
 	}
 
-	camera, err := lepton3.New(opts.Speed)
+	spiName := ""
+	if opts.CS >= 0 {
+		spiName, err = lepton3.SPIPortName(0, opts.CS)
+		if err != nil {
+			return err
+		}
+	}
+	camera, err := lepton3.NewWithDevices(opts.Speed, spiName, "")
 	if err != nil {
 		return err
 	}
@@ -93,6 +108,11 @@ func runMain() error {
 		log.Printf(t)
 	})
 
+	var agc lepton3.AGC
+	if opts.AGC != "" {
+		agc, _ = agcByName(opts.AGC)
+	}
+
 	rawFrame := lepton3.NewRawFrame()
 	frame := cptvframe.NewFrame(camera)
 	i := 0
@@ -112,7 +132,7 @@ func runMain() error {
 
 		if opts.Output == "png" {
 			filename := filepath.Join(opts.Directory, fmt.Sprintf("%05d.png", i))
-			err := dumpToPNG(filename, frame)
+			err := dumpToPNG(filename, frame, agc)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,58 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// LogLevel sets which messages are passed to the function given to
+// SetLogFunc. Each level includes the messages of the levels before
+// it.
+type LogLevel int32
+
+// Valid values for LogLevel.
+const (
+	LogError LogLevel = iota
+	LogWarn           // resyncs, timeouts and capture retries
+	LogInfo           // configuration changes made automatically (the default)
+	LogDebug          // per packet detail
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogError:
+		return "error"
+	case LogWarn:
+		return "warn"
+	case LogInfo:
+		return "info"
+	case LogDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// SetLogLevel sets the most detailed level of message logged. The
+// default is LogInfo. LogDebug logs every rejected packet so should
+// only be used during development. It is safe to call from any
+// goroutine, so the level can be changed while capturing.
+func (d *Lepton3) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32((*int32)(&d.logLevel), int32(level))
+}
+
+// logEnabled returns true if messages at level are logged. Per packet
+// callers check this before calling logf so that no formatting is done
+// when debug logging is off.
+func (d *Lepton3) logEnabled(level LogLevel) bool {
+	return LogLevel(atomic.LoadInt32((*int32)(&d.logLevel))) >= level
+}
+
+func (d *Lepton3) logf(level LogLevel, format string, args ...interface{}) {
+	if d.logEnabled(level) {
+		d.log(fmt.Sprintf(format, args...))
+	}
+}
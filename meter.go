@@ -0,0 +1,108 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"image"
+	"time"
+)
+
+// RegionMeter tracks the mean temperature of a fixed region of the
+// scene (e.g. a machine bearing) over time. The reading is averaged
+// over a window of recent frames, giving a stable value which isn't
+// affected by single frame noise. This suits monitoring slow changing
+// targets.
+type RegionMeter struct {
+	conv    *TempConverter
+	region  image.Rectangle
+	samples []meterSample
+	next    int
+	sum     float64
+}
+
+type meterSample struct {
+	t     time.Time
+	tempC float64
+}
+
+// NewRegionMeter returns a RegionMeter which averages the temperature
+// of region over the last window frames, converting pixel values
+// using conv (see Lepton3.TempConverter). Frames must be radiometric.
+func NewRegionMeter(conv *TempConverter, region image.Rectangle, window int) (*RegionMeter, error) {
+	if region.Empty() || !region.In(image.Rect(0, 0, FrameCols, FrameRows)) {
+		return nil, errors.New("region must be non-empty and lie within the frame")
+	}
+	if window < 1 {
+		return nil, errors.New("window must be at least 1 frame")
+	}
+	return &RegionMeter{
+		conv:    conv,
+		region:  region,
+		samples: make([]meterSample, 0, window),
+	}, nil
+}
+
+// Update adds the region's mean temperature in a raw frame to the
+// average, and returns the new smoothed value.
+func (m *RegionMeter) Update(raw []byte) float64 {
+	pix := raw[telemetryBytes:]
+	var sum float64
+	for y := m.region.Min.Y; y < m.region.Max.Y; y++ {
+		for x := m.region.Min.X; x < m.region.Max.X; x++ {
+			val := Big16.Uint16(pix[(y*FrameCols+x)*2:])
+			sum += m.conv.PixelToCelsius(x, y, val)
+		}
+	}
+	s := meterSample{
+		t:     time.Now(),
+		tempC: sum / float64(m.region.Dx()*m.region.Dy()),
+	}
+
+	if len(m.samples) < cap(m.samples) {
+		m.samples = append(m.samples, s)
+	} else {
+		m.sum -= m.samples[m.next].tempC
+		m.samples[m.next] = s
+		m.next = (m.next + 1) % len(m.samples)
+	}
+	m.sum += s.tempC
+	return m.Value()
+}
+
+// Value returns the smoothed temperature in Celsius, or 0 if no frames
+// have been added.
+func (m *RegionMeter) Value() float64 {
+	if len(m.samples) == 0 {
+		return 0
+	}
+	return m.sum / float64(len(m.samples))
+}
+
+// Trend returns the rate of change of the region's temperature over
+// the window in degrees Celsius per second, fitted using least
+// squares. It returns 0 until at least 2 frames have been added.
+func (m *RegionMeter) Trend() float64 {
+	if len(m.samples) < 2 {
+		return 0
+	}
+	first := m.samples[m.next%len(m.samples)]
+	var fit lineFit
+	for _, s := range m.samples {
+		fit.add(s.t.Sub(first.t).Seconds(), s.tempC)
+	}
+	slope, _, ok := fit.solve()
+	if !ok {
+		return 0
+	}
+	return slope
+}
+
+// Reset discards all frames added to the average.
+func (m *RegionMeter) Reset() {
+	m.samples = m.samples[:0]
+	m.next = 0
+	m.sum = 0
+}
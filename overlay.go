@@ -0,0 +1,224 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Tints used by SegmentOverlay, indexed by segment number - 1.
+var segmentTints = [segmentsPerFrame]color.RGBA{
+	{255, 96, 96, 255},
+	{96, 255, 96, 255},
+	{96, 96, 255, 255},
+	{255, 255, 96, 255},
+}
+
+// SegmentOverlay returns a debugging version of src with the pixels
+// from each of the frame's four segments tinted a different colour
+// (red, green, blue and yellow for segments 1 to 4). This makes frame
+// assembly problems, such as segments in the wrong order, obvious at
+// a glance. layout must be the telemetry layout the frame was captured
+// with, as this affects where the segment boundaries fall. src must be
+// a full frame.
+//
+// This is purely a developer aid and is separate from normal output.
+func SegmentOverlay(src *image.Gray16, layout TelemetryLayout) *image.RGBA {
+	gray := ToGray(src, nil)
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+
+	// Packet offset and packets per segment within the assembled
+	// frame (see frameBuilder.output).
+	offset, perSegment := telemetryPacketCount, packetsPerSegment
+	switch layout {
+	case TelemetryDisabled:
+		offset, perSegment = 0, packetsPerSegment-1
+	case TelemetryFooter:
+		offset = 0
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			packet := (y-b.Min.Y)*2 + (x-b.Min.X)/colsPerPacket
+			seg := (packet + offset) / perSegment
+			if seg >= segmentsPerFrame {
+				seg = segmentsPerFrame - 1
+			}
+			tint := segmentTints[seg]
+			v := uint32(gray.GrayAt(x, y).Y)
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(v * uint32(tint.R) / 255),
+				G: uint8(v * uint32(tint.G) / 255),
+				B: uint8(v * uint32(tint.B) / 255),
+				A: 255,
+			})
+		}
+	}
+	return dst
+}
+
+// ReadoutOptions selects the elements DrawReadout draws.
+type ReadoutOptions struct {
+	// Hotspot marks the hottest pixel with a crosshair.
+	Hotspot bool
+
+	// MaxTemp labels the hottest pixel with its temperature.
+	MaxTemp bool
+
+	// Spot is a spot meter region which, if not empty, is outlined
+	// and labelled with its mean temperature.
+	Spot image.Rectangle
+
+	// Color is the colour to draw in. The zero value means white.
+	Color color.RGBA
+}
+
+// DrawReadout burns a temperature readout for a raw frame into dst,
+// typically the output of Colorize for the same frame, for live
+// displays. dst must be the size of a frame. Text is drawn using a
+// small built-in font. ErrNotRadiometric is returned if the camera
+// isn't producing radiometric output.
+func (d *Lepton3) DrawReadout(dst *image.RGBA, raw []byte, opts ReadoutOptions) error {
+	if !d.Radiometric() {
+		return ErrNotRadiometric
+	}
+	b := dst.Bounds()
+	if b.Dx() != FrameCols || b.Dy() != FrameRows {
+		return fmt.Errorf("image must be %dx%d, got %dx%d", FrameCols, FrameRows, b.Dx(), b.Dy())
+	}
+	if !opts.Spot.Empty() && !opts.Spot.In(image.Rect(0, 0, FrameCols, FrameRows)) {
+		return errors.New("spot must lie within the frame")
+	}
+	col := opts.Color
+	if col == (color.RGBA{}) {
+		col = color.RGBA{255, 255, 255, 255}
+	}
+	set := func(x, y int, c color.RGBA) {
+		if p := image.Pt(b.Min.X+x, b.Min.Y+y); p.In(b) {
+			dst.SetRGBA(p.X, p.Y, c)
+		}
+	}
+	pix := raw[telemetryBytes:]
+
+	if opts.Hotspot || opts.MaxTemp {
+		var hx, hy int
+		var hot uint16
+		for i := 0; i < FrameCols*FrameRows; i++ {
+			if val := Big16.Uint16(pix[i*2:]); val > hot {
+				hot, hx, hy = val, i%FrameCols, i/FrameCols
+			}
+		}
+		if opts.Hotspot {
+			// Leave a gap so the pixel itself stays visible.
+			for i := 2; i <= 4; i++ {
+				set(hx-i, hy, col)
+				set(hx+i, hy, col)
+				set(hx, hy-i, col)
+				set(hx, hy+i, col)
+			}
+		}
+		if opts.MaxTemp {
+			text := formatTemp(d.tempConv.PixelToCelsius(hx, hy, hot))
+			x := hx + 6
+			if x+textWidth(text) > FrameCols {
+				x = hx - 6 - textWidth(text)
+			}
+			drawText(set, x, clampInt(hy-glyphHeight/2, 0, FrameRows-glyphHeight), text, col)
+		}
+	}
+
+	if !opts.Spot.Empty() {
+		r := opts.Spot
+		var sum float64
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				sum += d.tempConv.PixelToCelsius(x, y, Big16.Uint16(pix[(y*FrameCols+x)*2:]))
+			}
+		}
+		for x := r.Min.X - 1; x <= r.Max.X; x++ {
+			set(x, r.Min.Y-1, col)
+			set(x, r.Max.Y, col)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			set(r.Min.X-1, y, col)
+			set(r.Max.X, y, col)
+		}
+		text := formatTemp(sum / float64(r.Dx()*r.Dy()))
+		y := r.Min.Y - 2 - glyphHeight
+		if y < 0 {
+			y = r.Max.Y + 2
+		}
+		drawText(set, clampInt(r.Min.X-1, 0, FrameCols-textWidth(text)), y, text, col)
+	}
+	return nil
+}
+
+func formatTemp(c float64) string {
+	return fmt.Sprintf("%.1f\u00b0C", c)
+}
+
+func clampInt(v, min, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+// Glyphs of the 3x5 pixel font used by DrawReadout, covering the
+// characters in temperature readouts. Each row is 3 bits with the
+// leftmost pixel in the most significant bit.
+var readoutFont = map[rune][glyphHeight]uint8{
+	'0':      {7, 5, 5, 5, 7},
+	'1':      {2, 6, 2, 2, 7},
+	'2':      {7, 1, 7, 4, 7},
+	'3':      {7, 1, 7, 1, 7},
+	'4':      {5, 5, 7, 1, 1},
+	'5':      {7, 4, 7, 1, 7},
+	'6':      {7, 4, 7, 5, 7},
+	'7':      {7, 1, 1, 1, 1},
+	'8':      {7, 5, 7, 5, 7},
+	'9':      {7, 5, 7, 1, 7},
+	'.':      {0, 0, 0, 0, 2},
+	'-':      {0, 0, 7, 0, 0},
+	'C':      {7, 4, 4, 4, 7},
+	'\u00b0': {2, 5, 2, 0, 0},
+}
+
+const (
+	glyphWidth   = 3
+	glyphHeight  = 5
+	glyphAdvance = glyphWidth + 1
+)
+
+func textWidth(text string) int {
+	return len([]rune(text))*glyphAdvance - 1
+}
+
+// drawText draws text with its top left corner at (x, y), with a dark
+// shadow so that it is legible over any colour.
+func drawText(set func(x, y int, c color.RGBA), x, y int, text string, col color.RGBA) {
+	drawGlyphs(set, x+1, y+1, text, color.RGBA{0, 0, 0, 255})
+	drawGlyphs(set, x, y, text, col)
+}
+
+func drawGlyphs(set func(x, y int, c color.RGBA), x, y int, text string, col color.RGBA) {
+	for _, r := range text {
+		for row, bits := range readoutFont[r] {
+			for i := 0; i < glyphWidth; i++ {
+				if bits&(1<<uint(glyphWidth-1-i)) != 0 {
+					set(x+i, y+row, col)
+				}
+			}
+		}
+		x += glyphAdvance
+	}
+}
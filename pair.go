@@ -0,0 +1,81 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pair captures roughly time aligned frames from two cameras, for
+// stereo or multi-sensor setups. Each camera must be connected to its
+// own SPI port and I2C bus (see NewWithDevices).
+type Pair struct {
+	A *Lepton3
+	B *Lepton3
+}
+
+// NewPair returns a Pair managing the two cameras given.
+func NewPair(a, b *Lepton3) *Pair {
+	return &Pair{A: a, B: b}
+}
+
+// PairError reports which of the cameras in a Pair failed. A nil
+// field means that camera succeeded.
+type PairError struct {
+	A error
+	B error
+}
+
+func (e *PairError) Error() string {
+	return fmt.Sprintf("camera A: %v, camera B: %v", e.A, e.B)
+}
+
+func newPairError(errA, errB error) error {
+	if errA == nil && errB == nil {
+		return nil
+	}
+	return &PairError{A: errA, B: errB}
+}
+
+// Open opens both cameras. If one fails to open a *PairError is
+// returned but the other camera is left open so that it can continue
+// to be used.
+func (p *Pair) Open() error {
+	return newPairError(p.A.Open(), p.B.Open())
+}
+
+// Close closes both cameras.
+func (p *Pair) Close() {
+	p.A.Close()
+	p.B.Close()
+}
+
+// NextFrames reads the next frame from both cameras concurrently into
+// rawA and rawB, returning the time skew between them (the time the
+// frame from B was received minus the time the frame from A was
+// received).
+//
+// If either camera fails a *PairError is returned. The frame from the
+// other camera is still valid and the skew is meaningless.
+func (p *Pair) NextFrames(rawA, rawB []byte) (time.Duration, error) {
+	var wg sync.WaitGroup
+	var errA, errB error
+	var timeA, timeB time.Time
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errA = p.A.NextFrame(rawA)
+		timeA = time.Now()
+	}()
+	go func() {
+		defer wg.Done()
+		errB = p.B.NextFrame(rawB)
+		timeB = time.Now()
+	}()
+	wg.Wait()
+	return timeB.Sub(timeA), newPairError(errA, errB)
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+)
+
+// Palette is a lookup table which maps 8-bit intensities (0 = coldest,
+// 255 = hottest) to colours. Valid palettes have 256 entries.
+type Palette []color.RGBA
+
+// Predefined palettes.
+var (
+	GrayPalette = NewPalette(color.Black, color.White)
+
+	IronPalette = NewPalette(
+		color.RGBA{0, 0, 0, 255},
+		color.RGBA{32, 0, 140, 255},
+		color.RGBA{204, 0, 119, 255},
+		color.RGBA{255, 165, 0, 255},
+		color.RGBA{255, 255, 255, 255},
+	)
+
+	RainbowPalette = NewPalette(
+		color.RGBA{0, 0, 255, 255},
+		color.RGBA{0, 255, 255, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{255, 255, 0, 255},
+		color.RGBA{255, 0, 0, 255},
+	)
+)
+
+// NewPalette returns a Palette which linearly interpolates between
+// the colours given, which are spaced evenly from coldest to hottest.
+// At least 2 colours must be given.
+func NewPalette(stops ...color.Color) Palette {
+	if len(stops) < 2 {
+		panic("lepton3: a palette needs at least 2 colours")
+	}
+	rgba := make([]color.RGBA, len(stops))
+	for i, c := range stops {
+		rgba[i] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	p := make(Palette, 256)
+	segments := len(rgba) - 1
+	for i := range p {
+		pos := i * segments
+		seg := pos / 255
+		if seg >= segments {
+			seg = segments - 1
+		}
+		// Position within the segment, scaled to 0-255.
+		t := pos - seg*255
+		a, b := rgba[seg], rgba[seg+1]
+		p[i] = color.RGBA{
+			R: lerp8(a.R, b.R, t),
+			G: lerp8(a.G, b.G, t),
+			B: lerp8(a.B, b.B, t),
+			A: lerp8(a.A, b.A, t),
+		}
+	}
+	return p
+}
+
+func lerp8(a, b uint8, t int) uint8 {
+	return uint8((int(a)*(255-t) + int(b)*t + 127) / 255)
+}
+
+// Colorize returns a false colour version of src. The frame is
+// first converted to 8-bit using agc (MinMaxAGC if nil), so clipping,
+// equalisation and polarity are all respected, and the result is then
+// mapped to colours using palette.
+func Colorize(src *image.Gray16, agc AGC, palette Palette) (*image.RGBA, error) {
+	dst := image.NewRGBA(src.Bounds())
+	if err := ColorizeInto(src, agc, dst, palette); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// ColorizeInto is like Colorize but writes the false colour version of
+// src into dst, which must have the same bounds. No intermediate 8-bit
+// image is needed, so live view loops can avoid allocation by reusing
+// dst between frames.
+func ColorizeInto(src *image.Gray16, agc AGC, dst *image.RGBA, palette Palette) error {
+	if src.Bounds() != dst.Bounds() {
+		return fmt.Errorf("image bounds don't match: %v != %v", src.Bounds(), dst.Bounds())
+	}
+	if len(palette) != 256 {
+		return fmt.Errorf("palette must have 256 entries, got %d", len(palette))
+	}
+
+	agcInPlace(src, agc, dst.Pix, dst.Stride)
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := dst.Pix[dst.PixOffset(b.Min.X, y):]
+		for x := b.Dx() - 1; x >= 0; x-- {
+			c := palette[row[x]]
+			row[x*4] = c.R
+			row[x*4+1] = c.G
+			row[x*4+2] = c.B
+			row[x*4+3] = c.A
+		}
+	}
+	return nil
+}
+
+// grayViews holds the headers used by agcInPlace, so that it doesn't
+// allocate.
+var grayViews = sync.Pool{
+	New: func() interface{} { return new(image.Gray) },
+}
+
+// agcInPlace applies agc (MinMaxAGC if nil) to src, writing the 8-bit
+// output to the start of each row of pix, where rows are stride bytes
+// apart. Each output pixel takes several bytes, so the rows can then
+// be expanded to colours in place, working backwards from the end of
+// each row so that no 8-bit value is overwritten before it is used.
+func agcInPlace(src *image.Gray16, agc AGC, pix []byte, stride int) {
+	if agc == nil {
+		agc = MinMaxAGC{}
+	}
+	gray := grayViews.Get().(*image.Gray)
+	*gray = image.Gray{Pix: pix, Stride: stride, Rect: src.Bounds()}
+	agc.Apply(src, gray)
+	*gray = image.Gray{}
+	grayViews.Put(gray)
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// rampImage returns a 1 row image whose pixels increase from left to
+// right.
+func rampImage(vals ...uint16) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, len(vals), 1))
+	for x, v := range vals {
+		img.SetGray16(x, 0, color.Gray16{Y: v})
+	}
+	return img
+}
+
+func TestColorizeFollowsAGC(t *testing.T) {
+	src := rampImage(1000, 2000, 3000)
+	palette := RainbowPalette
+
+	tests := []struct {
+		name string
+		agc  AGC
+		want []uint8 // palette index of each pixel
+	}{
+		{"default", nil, []uint8{0, 128, 255}},
+		{"black hot", WithPolarity(MinMaxAGC{}, BlackHot), []uint8{255, 127, 0}},
+	}
+	for _, tt := range tests {
+		img, err := Colorize(src, tt.agc, palette)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for x, idx := range tt.want {
+			if got := img.RGBAAt(x, 0); got != palette[idx] {
+				t.Errorf("%s: pixel %d = %v, want palette[%d] = %v", tt.name, x, got, idx, palette[idx])
+			}
+		}
+	}
+}
+
+func TestColorizeFramebufferFollowsAGC(t *testing.T) {
+	src := rampImage(1000, 2000, 3000)
+	agc := WithPolarity(MinMaxAGC{}, BlackHot)
+	dst := make([]byte, 3*PixelBGRA8888.BytesPerPixel())
+	if err := ColorizeFramebuffer(src, agc, dst, PixelBGRA8888, IronPalette); err != nil {
+		t.Fatal(err)
+	}
+	// Black hot: the hottest pixel gets the coldest colour.
+	want := IronPalette[0]
+	if got := (color.RGBA{dst[10], dst[9], dst[8], dst[11]}); got != want {
+		t.Errorf("hottest pixel = %v, want %v", got, want)
+	}
+}
+
+func TestColorizeIntoBoundsMismatch(t *testing.T) {
+	src := image.NewGray16(image.Rect(0, 0, 2, 2))
+	dst := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	if err := ColorizeInto(src, nil, dst, GrayPalette); err == nil {
+		t.Error("expected an error for mismatched bounds")
+	}
+}
+
+func TestColorizeIntoMatchesColorize(t *testing.T) {
+	src := image.NewGray16(image.Rect(0, 0, FrameCols, FrameRows))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+	}
+	agc := WithPolarity(MinMaxAGC{}, BlackHot)
+	want, err := Colorize(src, agc, IronPalette)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := image.NewRGBA(src.Bounds())
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := ColorizeInto(src, agc, dst, IronPalette); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !bytes.Equal(dst.Pix, want.Pix) {
+		t.Error("ColorizeInto output differs from Colorize")
+	}
+	if allocs != 0 {
+		t.Errorf("ColorizeInto made %v allocations, want 0", allocs)
+	}
+}
+
+func TestColorizeFramebufferRGB565(t *testing.T) {
+	src := rampImage(1000, 2000, 3000)
+	dst := make([]byte, 3*PixelRGB565.BytesPerPixel())
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := ColorizeFramebuffer(src, nil, dst, PixelRGB565, GrayPalette); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := []byte{0x00, 0x00, 0x10, 0x84, 0xff, 0xff}
+	if !bytes.Equal(dst, want) {
+		t.Errorf("framebuffer = %x, want %x", dst, want)
+	}
+	if allocs != 0 {
+		t.Errorf("ColorizeFramebuffer made %v allocations, want 0", allocs)
+	}
+}
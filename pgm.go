@@ -0,0 +1,35 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"io"
+)
+
+// WritePGM writes the pixels of a raw frame to w as a binary (P5) PGM
+// image with a maxval of 65535. PGM stores 16-bit samples most
+// significant byte first, which matches the raw frame, so the pixels
+// are written without conversion. Telemetry isn't included.
+func WritePGM(w io.Writer, raw []byte) error {
+	if len(raw) < BytesPerFrame {
+		return fmt.Errorf("invalid raw frame size: %d", len(raw))
+	}
+	if _, err := fmt.Fprintf(w, "P5\n%d %d\n65535\n", FrameCols, FrameRows); err != nil {
+		return err
+	}
+	_, err := w.Write(raw[telemetryBytes : telemetryBytes+FrameRows*FrameCols*2])
+	return err
+}
+
+// SnapshotPGM captures a single frame (see Snapshot) and writes it to
+// w as a 16-bit PGM image (see WritePGM).
+func (d *Lepton3) SnapshotPGM(w io.Writer) error {
+	raw, err := d.Snapshot()
+	if err != nil {
+		return err
+	}
+	return WritePGM(w, raw)
+}
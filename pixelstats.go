@@ -0,0 +1,209 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+)
+
+// Mask marks pixels which should be excluded from statistics and AGC
+// calculations, such as parts of the scene which are permanently
+// saturated by a hot object. A nil *Mask masks nothing.
+type Mask struct {
+	bits []bool
+}
+
+// NewMask returns an empty mask sized for a Lepton 3 frame.
+func NewMask() *Mask {
+	return &Mask{bits: make([]bool, FrameCols*FrameRows)}
+}
+
+// AddRect masks all pixels within r. Parts of r outside the frame are
+// ignored.
+func (m *Mask) AddRect(r image.Rectangle) {
+	r = r.Intersect(image.Rect(0, 0, FrameCols, FrameRows))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			m.bits[y*FrameCols+x] = true
+		}
+	}
+}
+
+// AddPoint masks the pixel at (x, y).
+func (m *Mask) AddPoint(x, y int) {
+	m.AddRect(image.Rect(x, y, x+1, y+1))
+}
+
+// Masked returns true if the pixel at (x, y) is masked.
+func (m *Mask) Masked(x, y int) bool {
+	if m == nil || x < 0 || y < 0 || x >= FrameCols || y >= FrameRows {
+		return false
+	}
+	return m.bits[y*FrameCols+x]
+}
+
+// SetStatsMask sets the pixels excluded from the statistics calculated
+// for every frame read by NextFrame (see FrameInfo.Stats). Passing
+// the same mask to MinMaxAGC along with those statistics lets it
+// stretch the frame without another pass over the pixels. A nil mask
+// (the default) includes every pixel.
+func (d *Lepton3) SetStatsMask(mask *Mask) {
+	d.statsMask = mask
+}
+
+// MaxRawValue is the largest pixel value the camera produces. Pixel
+// values are 14-bit even though they are stored in 16 bits.
+const MaxRawValue = 1<<nativeBitDepth - 1
+
+// PixelStats holds statistics calculated from the pixels of a frame.
+// Min and Max give the range of values actually present, which is
+// usually much narrower than the full 14-bit range.
+type PixelStats struct {
+	Min   uint16
+	Max   uint16
+	Mean  float64
+	Count int // number of pixels included (i.e. not masked)
+
+	// Over14Bit is the number of pixels with values above
+	// MaxRawValue. These can't come from the camera's sensor so
+	// indicate telemetry or corrupt data leaking into the pixels.
+	Over14Bit int
+}
+
+// Valid14Bit returns true if all the pixels fit within the camera's
+// 14-bit output range.
+func (s PixelStats) Valid14Bit() bool {
+	return s.Over14Bit == 0
+}
+
+// RangeUsed returns the fraction (between 0 and 1) of the camera's
+// 14-bit output range spanned by the pixels. A persistently small
+// value indicates a low contrast scene, where AGC is essential for a
+// useful image.
+func (s PixelStats) RangeUsed() float64 {
+	return rangeUsed(s.Min, s.Max)
+}
+
+func rangeUsed(min, max uint16) float64 {
+	if max > MaxRawValue {
+		max = MaxRawValue
+	}
+	if max <= min {
+		return 0
+	}
+	return float64(max-min) / MaxRawValue
+}
+
+// framePixelStats is like ComputePixelStats but works directly on the
+// pixels of a frame (a raw frame without its telemetry). In the same
+// pass it finds the hottest and coldest pixels in region, whether or
+// not they're masked, for checkAlarms. If region is empty hot.Raw is
+// 0 and cold.Raw is 0xFFFF.
+func framePixelStats(pix []byte, mask *Mask, region image.Rectangle) (stats PixelStats, hot, cold Alarm) {
+	stats.Min = math.MaxUint16
+	hot.Raw, cold.Raw = 0, 0xFFFF
+	var sum uint64
+	i := 0
+	for y := 0; y < FrameRows; y++ {
+		inRegion := y >= region.Min.Y && y < region.Max.Y
+		for x := 0; x < FrameCols; x++ {
+			val := Big16.Uint16(pix[i:])
+			if !mask.Masked(x, y) {
+				if val < stats.Min {
+					stats.Min = val
+				}
+				if val > stats.Max {
+					stats.Max = val
+				}
+				if val > MaxRawValue {
+					stats.Over14Bit++
+				}
+				sum += uint64(val)
+				stats.Count++
+			}
+			if inRegion && x >= region.Min.X && x < region.Max.X {
+				if val >= hot.Raw {
+					hot.Raw, hot.X, hot.Y = val, x, y
+				}
+				if val <= cold.Raw {
+					cold.Raw, cold.X, cold.Y = val, x, y
+				}
+			}
+			i += 2
+		}
+	}
+	if stats.Count == 0 {
+		stats.Min = 0
+		return stats, hot, cold
+	}
+	stats.Mean = float64(sum) / float64(stats.Count)
+	return stats, hot, cold
+}
+
+// ComputePixelStats calculates the minimum, maximum and mean pixel
+// values of img, skipping any pixels excluded by mask (which may be
+// nil).
+func ComputePixelStats(img *image.Gray16, mask *Mask) PixelStats {
+	stats := PixelStats{Min: math.MaxUint16}
+	var sum uint64
+	forEachGray16(img, func(x, y int, val uint16) {
+		if mask.Masked(x, y) {
+			return
+		}
+		if val < stats.Min {
+			stats.Min = val
+		}
+		if val > stats.Max {
+			stats.Max = val
+		}
+		if val > MaxRawValue {
+			stats.Over14Bit++
+		}
+		sum += uint64(val)
+		stats.Count++
+	})
+	if stats.Count == 0 {
+		stats.Min = 0
+		return stats
+	}
+	stats.Mean = float64(sum) / float64(stats.Count)
+	return stats
+}
+
+// Sharpness returns a focus score for img, calculated as the variance
+// of the Laplacian (a measure of edge strength) over the image. Higher
+// scores indicate a sharper image. This is useful when manually
+// focusing cameras with adjustable lenses: adjust the focus to
+// maximise the score.
+//
+// Scores are only comparable between frames of the same scene. Thermal
+// scenes with little temperature contrast have few edges so give low
+// scores regardless of focus. Pointing the camera at something with
+// sharp temperature boundaries (e.g. a hand or a mug of hot water)
+// gives a much more meaningful result.
+func Sharpness(img *image.Gray16) float64 {
+	b := img.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return 0
+	}
+	at := func(x, y int) float64 {
+		return float64(binary.BigEndian.Uint16(img.Pix[img.PixOffset(x, y):]))
+	}
+
+	var sum, sumSq float64
+	n := 0
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		for x := b.Min.X + 1; x < b.Max.X-1; x++ {
+			lap := at(x-1, y) + at(x+1, y) + at(x, y-1) + at(x, y+1) - 4*at(x, y)
+			sum += lap
+			sumSq += lap * lap
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	return sumSq/float64(n) - mean*mean
+}
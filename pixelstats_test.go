@@ -0,0 +1,69 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFramePixelStatsAlarmRegion(t *testing.T) {
+	pix := make([]byte, FrameCols*FrameRows*2)
+	set := func(x, y int, val uint16) {
+		Big16.PutUint16(pix[(y*FrameCols+x)*2:], val)
+	}
+	for y := 0; y < FrameRows; y++ {
+		for x := 0; x < FrameCols; x++ {
+			set(x, y, 3000)
+		}
+	}
+	set(0, 0, 9000) // outside the region
+	set(20, 15, 5000)
+	set(25, 12, 1000)
+
+	region := image.Rect(10, 10, 30, 20)
+	stats, hot, cold := framePixelStats(pix, nil, region)
+	if stats.Min != 1000 || stats.Max != 9000 {
+		t.Errorf("stats min/max = %d/%d, want 1000/9000", stats.Min, stats.Max)
+	}
+	if hot.Raw != 5000 || hot.X != 20 || hot.Y != 15 {
+		t.Errorf("hottest pixel = %d at (%d, %d), want 5000 at (20, 15)", hot.Raw, hot.X, hot.Y)
+	}
+	if cold.Raw != 1000 || cold.X != 25 || cold.Y != 12 {
+		t.Errorf("coldest pixel = %d at (%d, %d), want 1000 at (25, 12)", cold.Raw, cold.X, cold.Y)
+	}
+
+	_, hot, cold = framePixelStats(pix, nil, image.Rectangle{})
+	if hot.Raw != 0 || cold.Raw != 0xFFFF {
+		t.Errorf("empty region gave hottest %d and coldest %d", hot.Raw, cold.Raw)
+	}
+}
+
+func TestFramePixelStatsMask(t *testing.T) {
+	img := NewGray16()
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.SetGray16(5, 5, color.Gray16{Y: 0xFFFF}) // permanently hot
+	mask := NewMask()
+	mask.AddPoint(5, 5)
+
+	stats, _, _ := framePixelStats(img.Pix, mask, image.Rectangle{})
+	if want := ComputePixelStats(img, mask); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	// MinMaxAGC gives the same output using the stats as finding
+	// the range itself.
+	want := image.NewGray(img.Bounds())
+	MinMaxAGC{Mask: mask}.Apply(img, want)
+	got := image.NewGray(img.Bounds())
+	MinMaxAGC{Stats: &stats}.Apply(img, got)
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("MinMaxAGC output differs when given stats")
+	}
+}
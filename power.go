@@ -0,0 +1,85 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+// The time allowed for the camera to boot after being powered on.
+const powerOnTimeout = 10 * time.Second
+
+// PowerCycle configures power cycling of the camera using a GPIO
+// controlled power line. This is the only reliable way to recover from
+// some camera lock-ups, which matters for unattended installations.
+type PowerCycle struct {
+	// Pin switches the camera's power. Driving it high powers the
+	// camera on.
+	Pin gpio.PinOut
+
+	// Failures is the number of consecutive failed attempts to read
+	// from the camera in RunCapture after which the camera is power
+	// cycled. It must be less than the number of failures after which
+	// RunCapture gives up.
+	Failures int
+
+	// OffTime is how long the camera is left without power.
+	OffTime time.Duration
+}
+
+// SetPowerCycle enables automatic power cycling of the camera by
+// RunCapture when reading frames fails persistently. Passing nil
+// disables it (the default).
+func (d *Lepton3) SetPowerCycle(cfg *PowerCycle) error {
+	if cfg == nil {
+		d.powerCycle = nil
+		return nil
+	}
+	if cfg.Pin == nil {
+		return errors.New("power cycle pin must be set")
+	}
+	if cfg.Failures < 1 || cfg.Failures >= captureMaxFailures {
+		return fmt.Errorf("power cycle failures must be between 1 and %d", captureMaxFailures-1)
+	}
+	if cfg.OffTime <= 0 {
+		return errors.New("power cycle off time must be positive")
+	}
+	c := *cfg
+	d.powerCycle = &c
+	return nil
+}
+
+// PowerCycle switches the camera off and on again using the pin
+// configured with SetPowerCycle, then waits for it to boot (see
+// WaitReady). The camera is closed first if it is open, and is left
+// closed.
+func (d *Lepton3) PowerCycle() error {
+	if d.powerCycle == nil {
+		return errors.New("power cycling hasn't been configured")
+	}
+	if d.IsOpen() {
+		d.Close()
+	}
+	if d.cciDev != nil {
+		d.cciDev.Close()
+		d.cciDev = nil
+	}
+
+	pin := d.powerCycle.Pin
+	if err := pin.Out(gpio.Low); err != nil {
+		return fmt.Errorf("failed to switch camera off: %v", err)
+	}
+	time.Sleep(d.powerCycle.OffTime)
+	if err := pin.Out(gpio.High); err != nil {
+		return fmt.Errorf("failed to switch camera on: %v", err)
+	}
+	d.frameBuilder.reset()
+	d.tlinearKnown = false
+	return d.WaitReady(powerOnTimeout)
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// QualityGate configures checks on the pixels of each assembled frame
+// which catch corruption that passes the packet level checks. A frame
+// which is all one value, or has extreme salt and pepper noise, is
+// almost certainly corrupt.
+type QualityGate struct {
+	// MinStdDev is the lowest standard deviation of pixel values
+	// accepted. Real scenes always have some sensor noise, so frames
+	// with (close to) no variation are rejected. 0 disables the
+	// check.
+	MinStdDev float64
+
+	// MaxStdDev is the highest standard deviation of pixel values
+	// accepted. 0 disables the check.
+	MaxStdDev float64
+
+	// NoiseThreshold is the amount by which a pixel must be above
+	// (or below) all four of its neighbours to be counted as a bad
+	// (salt and pepper) pixel.
+	NoiseThreshold uint16
+
+	// MaxBadPixels is the largest number of bad pixels accepted. It
+	// is ignored if NoiseThreshold is 0.
+	MaxBadPixels int
+
+	// Resync causes rejected frames to trigger a resync. Otherwise
+	// they are skipped and the next frame is read. Skipped frames
+	// count towards the frame timeout.
+	Resync bool
+}
+
+// SetQualityGate enables checking of frame quality using the
+// configuration given. Passing nil disables the checks (the default).
+// Rejected frames are counted in Stats.
+func (d *Lepton3) SetQualityGate(cfg *QualityGate) error {
+	if cfg == nil {
+		d.quality = nil
+		return nil
+	}
+	if cfg.MinStdDev < 0 || cfg.MaxStdDev < 0 {
+		return errors.New("standard deviation bounds can't be negative")
+	}
+	if cfg.MaxStdDev > 0 && cfg.MinStdDev > cfg.MaxStdDev {
+		return errors.New("minimum standard deviation is above the maximum")
+	}
+	if cfg.MaxBadPixels < 0 {
+		return errors.New("maximum bad pixels can't be negative")
+	}
+	c := *cfg
+	d.quality = &c
+	return nil
+}
+
+// check returns an error describing why a raw frame fails the quality
+// gate, or nil if it passes.
+func (g *QualityGate) check(raw []byte) error {
+	pix := raw[telemetryBytes:]
+	at := func(x, y int) int {
+		return int(Big16.Uint16(pix[(y*FrameCols+x)*2:]))
+	}
+
+	if g.MinStdDev > 0 || g.MaxStdDev > 0 {
+		var sum, sumSq float64
+		for i := 0; i < FrameCols*FrameRows; i++ {
+			v := float64(Big16.Uint16(pix[i*2:]))
+			sum += v
+			sumSq += v * v
+		}
+		n := float64(FrameCols * FrameRows)
+		mean := sum / n
+		stdDev := math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+		if stdDev < g.MinStdDev {
+			return fmt.Errorf("pixel standard deviation too low: %.2f", stdDev)
+		}
+		if g.MaxStdDev > 0 && stdDev > g.MaxStdDev {
+			return fmt.Errorf("pixel standard deviation too high: %.2f", stdDev)
+		}
+	}
+
+	if g.NoiseThreshold > 0 {
+		thresh := int(g.NoiseThreshold)
+		bad := 0
+		for y := 1; y < FrameRows-1; y++ {
+			for x := 1; x < FrameCols-1; x++ {
+				v := at(x, y)
+				lo, hi := at(x-1, y), at(x-1, y)
+				for _, n := range [...]int{at(x+1, y), at(x, y-1), at(x, y+1)} {
+					if n < lo {
+						lo = n
+					}
+					if n > hi {
+						hi = n
+					}
+				}
+				if v-hi > thresh || lo-v > thresh {
+					bad++
+				}
+			}
+		}
+		if bad > g.MaxBadPixels {
+			return fmt.Errorf("too many bad pixels: %d", bad)
+		}
+	}
+	return nil
+}
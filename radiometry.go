@@ -0,0 +1,277 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+const (
+	// TLinearResolutionHigh is the kelvin per count of radiometric
+	// (TLinear) pixel values when the camera's TLinear resolution is
+	// set to 0.01 K, its default.
+	TLinearResolutionHigh = 0.01
+	// TLinearResolutionLow is the kelvin per count of radiometric
+	// (TLinear) pixel values when the camera's TLinear resolution is
+	// set to 0.1 K, which allows hotter scenes to be measured.
+	TLinearResolutionLow = 0.1
+
+	zeroCelsiusInKelvin = 273.15
+)
+
+// TempConverter converts radiometric (TLinear) pixel values to
+// temperatures, optionally correcting for the emissivity of the
+// objects in the scene.
+//
+// The camera's own calibration assumes an emissivity of 1 (a perfect
+// black body). For other materials, some of the radiation seen comes
+// from the surroundings being reflected by the object, so the
+// measured temperature is corrected using:
+//
+//	T_obj⁴ = (T_meas⁴ - (1 - e) * T_refl⁴) / e
+//
+// where e is the emissivity and T_refl is the reflected (ambient)
+// temperature, in kelvin.
+type TempConverter struct {
+	// Resolution is the kelvin per count of the pixel values, as set
+	// by the camera's TLinear resolution. See TLinearResolutionHigh
+	// and TLinearResolutionLow.
+	Resolution float64
+
+	// Gain is the camera's gain mode. In GainAuto the camera switches
+	// between high and low gain as the scene changes, so a
+	// temperature doesn't map to a single raw value (see
+	// FromCelsius).
+	//
+	// The converter returned by Lepton3.TempConverter has Resolution
+	// and Gain kept up to date with the camera (see
+	// Lepton3.RefreshRadiometric).
+	Gain GainMode
+
+	// Emissivity is the default emissivity used for all pixels
+	// (0 < e <= 1).
+	Emissivity float64
+
+	// ReflectedTempC is the apparent temperature of the surroundings
+	// reflected by objects in the scene.
+	ReflectedTempC float64
+
+	emissivityMap []float64
+}
+
+// NewTempConverter returns a TempConverter for the camera's default
+// TLinear output (high gain with 0.01 K resolution) with no emissivity
+// correction.
+func NewTempConverter() *TempConverter {
+	return &TempConverter{
+		Resolution:     TLinearResolutionHigh,
+		Gain:           GainHigh,
+		Emissivity:     1.0,
+		ReflectedTempC: 20.0,
+	}
+}
+
+// SetEmissivityMap sets a per-pixel emissivity map, allowing scenes
+// containing multiple materials to be corrected. The map is in row
+// major order and must have FrameCols*FrameRows entries. Entries which
+// are 0 fall back to Emissivity. Passing nil removes the map.
+func (c *TempConverter) SetEmissivityMap(emissivities []float64) error {
+	if emissivities == nil {
+		c.emissivityMap = nil
+		return nil
+	}
+	if len(emissivities) != FrameCols*FrameRows {
+		return fmt.Errorf("emissivity map must have %d entries, got %d",
+			FrameCols*FrameRows, len(emissivities))
+	}
+	for i, e := range emissivities {
+		if e < 0 || e > 1 {
+			return fmt.Errorf("invalid emissivity at (%d, %d): %v", i%FrameCols, i/FrameCols, e)
+		}
+	}
+	c.emissivityMap = emissivities
+	return nil
+}
+
+// ToCelsius converts a single pixel value to a temperature, using the
+// default Emissivity.
+func (c *TempConverter) ToCelsius(raw uint16) float64 {
+	return c.correct(raw, c.Emissivity)
+}
+
+// FromCelsius is the inverse of ToCelsius, converting a temperature to
+// the equivalent raw pixel value using the configured Resolution and
+// default Emissivity. This allows temperature thresholds to be
+// compared against raw pixel values without converting whole frames.
+// The result is rounded to the nearest count and clamped to the range
+// of a uint16. An error is returned unless Gain is GainHigh or
+// GainLow, as the raw value depends on which gain the camera is using.
+func (c *TempConverter) FromCelsius(celsius float64) (uint16, error) {
+	if c.Gain != GainHigh && c.Gain != GainLow {
+		return 0, fmt.Errorf("can't convert temperatures to raw values in %v gain mode", c.Gain)
+	}
+	measuredK := celsius + zeroCelsiusInKelvin
+	if measuredK <= 0 {
+		return 0, nil
+	}
+	if e := c.Emissivity; e > 0 && e < 1 {
+		reflectedK := c.ReflectedTempC + zeroCelsiusInKelvin
+		measuredK = math.Pow(e*math.Pow(measuredK, 4)+(1-e)*math.Pow(reflectedK, 4), 0.25)
+	}
+	raw := math.Round(measuredK / c.Resolution)
+	if raw > math.MaxUint16 {
+		return math.MaxUint16, nil
+	}
+	return uint16(raw), nil
+}
+
+// PixelToCelsius converts the pixel value at (x, y) to a temperature,
+// using the emissivity map where it is set.
+func (c *TempConverter) PixelToCelsius(x, y int, raw uint16) float64 {
+	return c.correct(raw, c.emissivityAt(x, y))
+}
+
+// FrameToCelsius converts all the pixels in frame into temperatures,
+// which are written into out. out must have the same dimensions as
+// frame.Pix.
+func (c *TempConverter) FrameToCelsius(frame *cptvframe.Frame, out [][]float64) error {
+	if len(out) != len(frame.Pix) {
+		return errors.New("output rows don't match frame")
+	}
+	for y, row := range frame.Pix {
+		if len(out[y]) != len(row) {
+			return errors.New("output columns don't match frame")
+		}
+		for x, val := range row {
+			out[y][x] = c.correct(val, c.emissivityAt(x, y))
+		}
+	}
+	return nil
+}
+
+func (c *TempConverter) emissivityAt(x, y int) float64 {
+	if c.emissivityMap != nil {
+		if e := c.emissivityMap[y*FrameCols+x]; e > 0 {
+			return e
+		}
+	}
+	return c.Emissivity
+}
+
+func (c *TempConverter) correct(raw uint16, emissivity float64) float64 {
+	measuredK := float64(raw) * c.Resolution
+	if emissivity <= 0 || emissivity >= 1 {
+		return measuredK - zeroCelsiusInKelvin
+	}
+	reflectedK := c.ReflectedTempC + zeroCelsiusInKelvin
+	objK4 := (math.Pow(measuredK, 4) - (1-emissivity)*math.Pow(reflectedK, 4)) / emissivity
+	if objK4 <= 0 {
+		return -zeroCelsiusInKelvin
+	}
+	return math.Pow(objK4, 0.25) - zeroCelsiusInKelvin
+}
+
+// ErrNotRadiometric is returned when converting pixel values to
+// temperatures while the camera isn't producing radiometric (TLinear)
+// output, as the conversion would give meaningless results.
+var ErrNotRadiometric = errors.New("camera isn't producing radiometric (TLinear) output")
+
+// Radiometric returns true if the camera is producing radiometric
+// (TLinear) output, meaning pixel values can be converted to
+// temperatures. The state is queried from the camera when it is opened
+// and then cached. Use RefreshRadiometric if the camera's
+// configuration may have changed since.
+func (d *Lepton3) Radiometric() bool {
+	if !d.tlinearKnown {
+		d.RefreshRadiometric()
+	}
+	return d.tlinear
+}
+
+// RefreshRadiometric queries whether the camera is producing
+// radiometric (TLinear) output, updating the cached state returned by
+// Radiometric. For radiometric output the camera's gain mode and
+// TLinear resolution are also read into TempConverter. Non-radiometric
+// models report that the query isn't supported, which is treated as
+// TLinear being disabled. Any other error is returned and leaves the
+// cached state unchanged.
+func (d *Lepton3) RefreshRadiometric() (bool, error) {
+	if d.cciDev == nil {
+		return false, errors.New("cant check radiometry as cciDev is nil, is the camera open?")
+	}
+	enabled, err := d.cciDev.regs.tlinearEnabled(context.Background())
+	if cciErr, ok := err.(*cciError); ok && cciErr.unsupported() {
+		enabled, err = false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("RefreshRadiometric: %v", err)
+	}
+	if enabled {
+		ctx := context.Background()
+		var gain GainMode
+		if err := d.cciDev.regs.get(ctx, sysGainMode, &gain); err != nil {
+			return false, fmt.Errorf("RefreshRadiometric: reading gain mode: %v", err)
+		}
+		var res uint32
+		if err := d.cciDev.regs.get(ctx, radTLinearResolution, &res); err != nil {
+			return false, fmt.Errorf("RefreshRadiometric: reading TLinear resolution: %v", err)
+		}
+		d.tempConv.Gain = gain
+		d.tempConv.Resolution = TLinearResolutionLow
+		if res == radResolution001 {
+			d.tempConv.Resolution = TLinearResolutionHigh
+		}
+	}
+	d.tlinear = enabled
+	d.tlinearKnown = true
+	return d.tlinear, nil
+}
+
+// ToCelsius converts a single pixel value to a temperature using the
+// camera's TempConverter. ErrNotRadiometric is returned if the camera
+// isn't producing radiometric output.
+func (d *Lepton3) ToCelsius(raw uint16) (float64, error) {
+	if !d.Radiometric() {
+		return 0, ErrNotRadiometric
+	}
+	return d.tempConv.ToCelsius(raw), nil
+}
+
+// FrameToCelsius converts all the pixels in frame into temperatures
+// using the camera's TempConverter (see TempConverter.FrameToCelsius).
+// ErrNotRadiometric is returned if the camera isn't producing
+// radiometric output.
+func (d *Lepton3) FrameToCelsius(frame *cptvframe.Frame, out [][]float64) error {
+	if !d.Radiometric() {
+		return ErrNotRadiometric
+	}
+	return d.tempConv.FrameToCelsius(frame, out)
+}
+
+// RowToCelsius converts a single row of a raw frame (see RawRow) into
+// temperatures using the camera's TempConverter. out must hold at
+// least FrameCols values. ErrNotRadiometric is returned if the camera
+// isn't producing radiometric output.
+func (d *Lepton3) RowToCelsius(raw []byte, row int, out []float64) error {
+	if !d.Radiometric() {
+		return ErrNotRadiometric
+	}
+	var vals [FrameCols]uint16
+	if err := RawRow(raw, row, vals[:]); err != nil {
+		return err
+	}
+	if len(out) < FrameCols {
+		return fmt.Errorf("output slice too small: %d < %d", len(out), FrameCols)
+	}
+	for x, val := range vals {
+		out[x] = d.tempConv.PixelToCelsius(x, row, val)
+	}
+	return nil
+}
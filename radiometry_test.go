@@ -0,0 +1,171 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRefreshRadiometric(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		code    int8 // LEP_RESULT for the query, 0 for success
+		want    bool
+		wantErr bool
+	}{
+		{name: "enabled", enabled: true, want: true},
+		{name: "disabled"},
+		{name: "undefined function", code: lepUndefinedFunction},
+		{name: "function not supported", code: lepFunctionNotSupported},
+		{name: "other camera error", code: -1, wantErr: true},
+		{name: "range error", code: -3, wantErr: true},
+	}
+	for _, tt := range tests {
+		cciBus := newFakeCCI()
+		if tt.enabled {
+			cciBus.setAttr(radTLinearEnable, 1, 0)
+		}
+		if tt.code != 0 {
+			cciBus.errs[radTLinearEnable.id] = tt.code
+		}
+		d, cleanup := newTestCamera(t, new(fakeSPI), cciBus)
+		got, err := d.RefreshRadiometric()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+		if got != tt.want || d.Radiometric() != tt.want {
+			t.Errorf("%s: got radiometric %v, want %v", tt.name, got, tt.want)
+		}
+		cleanup()
+	}
+}
+
+func TestRefreshRadiometricBusError(t *testing.T) {
+	cciBus := newFakeCCI()
+	cciBus.setAttr(radTLinearEnable, 1, 0)
+	d, cleanup := newTestCamera(t, new(fakeSPI), cciBus)
+	defer cleanup()
+	if _, err := d.RefreshRadiometric(); err != nil {
+		t.Fatal(err)
+	}
+
+	cciBus.mu.Lock()
+	cciBus.busErr = errors.New("i2c failure")
+	cciBus.mu.Unlock()
+	if _, err := d.RefreshRadiometric(); err == nil {
+		t.Error("bus error not returned")
+	}
+	// A failed query mustn't change the cached state.
+	if !d.Radiometric() {
+		t.Error("bus error cleared the radiometric state")
+	}
+
+	// Open carries on but logs the failure.
+	var log testLog
+	d.SetLogFunc(log.log)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if log.count("RefreshRadiometric") != 1 {
+		t.Errorf("bus error at open not logged: %q", log.lines)
+	}
+	cciBus.mu.Lock()
+	cciBus.busErr = nil
+	cciBus.mu.Unlock()
+}
+
+func TestFromCelsius(t *testing.T) {
+	tests := []struct {
+		name    string
+		gain    GainMode
+		res     float64
+		celsius float64
+		want    uint16
+		wantErr bool
+	}{
+		{name: "0.01 K", gain: GainHigh, res: TLinearResolutionHigh, celsius: 20, want: 29315},
+		{name: "0.1 K", gain: GainHigh, res: TLinearResolutionLow, celsius: 20.05, want: 2932},
+		{name: "low gain", gain: GainLow, res: TLinearResolutionHigh, celsius: 20, want: 29315},
+		{name: "rounds down", gain: GainHigh, res: TLinearResolutionHigh, celsius: 20.00449, want: 29315},
+		{name: "rounds up", gain: GainHigh, res: TLinearResolutionHigh, celsius: 20.0051, want: 29316},
+		{name: "below absolute zero", gain: GainHigh, res: TLinearResolutionHigh, celsius: -300, want: 0},
+		{name: "above range", gain: GainHigh, res: TLinearResolutionHigh, celsius: 1000, want: 65535},
+		{name: "auto gain", gain: GainAuto, res: TLinearResolutionHigh, celsius: 20, wantErr: true},
+		{name: "unknown gain", gain: GainMode(7), res: TLinearResolutionHigh, celsius: 20, wantErr: true},
+	}
+	for _, tt := range tests {
+		c := NewTempConverter()
+		c.Gain = tt.gain
+		c.Resolution = tt.res
+		got, err := c.FromCelsius(tt.celsius)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshRadiometricConverter(t *testing.T) {
+	tests := []struct {
+		gain GainMode
+		res  uint32 // radTLinearResolution setting
+		want float64
+	}{
+		{GainHigh, radResolution001, TLinearResolutionHigh},
+		{GainHigh, radResolution01, TLinearResolutionLow},
+		{GainLow, radResolution001, TLinearResolutionHigh},
+		{GainLow, radResolution01, TLinearResolutionLow},
+		{GainAuto, radResolution001, TLinearResolutionHigh},
+	}
+	for _, tt := range tests {
+		cciBus := newFakeCCI()
+		cciBus.setAttr(radTLinearEnable, 1, 0)
+		cciBus.setAttr(sysGainMode, uint16(tt.gain), 0)
+		cciBus.setAttr(radTLinearResolution, uint16(tt.res), 0)
+		d, cleanup := newTestCamera(t, new(fakeSPI), cciBus)
+		if _, err := d.RefreshRadiometric(); err != nil {
+			t.Fatal(err)
+		}
+		conv := d.TempConverter()
+		if conv.Gain != tt.gain || conv.Resolution != tt.want {
+			t.Errorf("%v gain, resolution setting %d: got gain %v and resolution %v, want resolution %v",
+				tt.gain, tt.res, conv.Gain, conv.Resolution, tt.want)
+		}
+		_, err := conv.FromCelsius(20)
+		if (err != nil) != (tt.gain == GainAuto) {
+			t.Errorf("%v gain: FromCelsius error: %v", tt.gain, err)
+		}
+		cleanup()
+	}
+}
+
+func TestRadiometricNotQueriedOnResync(t *testing.T) {
+	cciBus := newFakeCCI()
+	cciBus.setAttr(radTLinearEnable, 1, 0)
+	spiConn := &fakeSPI{repeat: testFrame(TelemetryHeader, 1)}
+	spiConn.send(testPacket(maxPacketNum+1, 0, 0))
+	d, cleanup := newTestCamera(t, spiConn, cciBus)
+	defer cleanup()
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.NextFrame(NewRawFrame()); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.LastFrameInfo().Resyncs; n != 1 {
+		t.Fatalf("got %d resyncs, want 1", n)
+	}
+	if n := cciBus.count(radTLinearEnable); n != 1 {
+		t.Errorf("TLinear queried %d times, want once on Open", n)
+	}
+	if !d.Radiometric() {
+		t.Error("not radiometric")
+	}
+}
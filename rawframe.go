@@ -2,6 +2,8 @@ package lepton3
 
 import (
 	"encoding/binary"
+	"fmt"
+	"runtime"
 
 	"github.com/TheCacophonyProject/go-cptv/cptvframe"
 )
@@ -31,3 +33,74 @@ func ParseRawFrame(raw []byte, out *cptvframe.Frame) error {
 
 	return nil
 }
+
+// parseRawPixels decodes the pixels of a raw frame into out in row
+// major order. out must hold at least FrameCols*FrameRows values.
+func parseRawPixels(raw []byte, out []uint16) {
+	rawPix := raw[telemetryBytes:]
+	for i := range out[:FrameCols*FrameRows] {
+		out[i] = binary.BigEndian.Uint16(rawPix[i*2:])
+	}
+}
+
+// RawRow decodes a single row of a raw frame into out, which must hold
+// at least FrameCols values. Only the bytes for the requested row are
+// read, which suits line scan applications that only need one row of
+// each frame.
+func RawRow(raw []byte, row int, out []uint16) error {
+	if row < 0 || row >= FrameRows {
+		return fmt.Errorf("row %d out of range (0-%d)", row, FrameRows-1)
+	}
+	if len(out) < FrameCols {
+		return fmt.Errorf("output slice too small: %d < %d", len(out), FrameCols)
+	}
+	rowPix := raw[telemetryBytes+row*FrameCols*2:]
+	for x := range out[:FrameCols] {
+		out[x] = binary.BigEndian.Uint16(rowPix[x*2:])
+	}
+	return nil
+}
+
+// NativePixels writes the pixels of a raw frame to dst as FrameRows x
+// FrameCols 16-bit values in the host's native byte order, in row
+// major order. This is the layout expected by image processing
+// libraries such as OpenCV. dst must hold at least
+// FrameRows*FrameCols*2 bytes, and raw is left unchanged.
+//
+// Reusing dst for every frame avoids a further copy, for example with
+// gocv a Mat can be made from dst once and then updated in place:
+//
+//	pix := make([]byte, lepton3.FrameRows*lepton3.FrameCols*2)
+//	mat, err := gocv.NewMatFromBytes(lepton3.FrameRows, lepton3.FrameCols, gocv.MatTypeCV16U, pix)
+//	...
+//	err = lepton3.NativePixels(raw, pix)
+//
+// The Mat shares memory with dst, so it is only valid while dst is,
+// and its contents change on every call to NativePixels with dst.
+func NativePixels(raw, dst []byte) error {
+	const size = FrameRows * FrameCols * 2
+	if len(dst) < size {
+		return fmt.Errorf("output slice too small: %d < %d", len(dst), size)
+	}
+	pix := raw[telemetryBytes : telemetryBytes+size]
+	if !nativeLittleEndian {
+		copy(dst, pix)
+		return nil
+	}
+	for i := 0; i < size; i += 2 {
+		dst[i], dst[i+1] = pix[i+1], pix[i]
+	}
+	return nil
+}
+
+// nativeLittleEndian is true if the host stores integers least
+// significant byte first, as all the architectures Go supports do
+// except those listed.
+var nativeLittleEndian = func() bool {
+	switch runtime.GOARCH {
+	case "armbe", "arm64be", "mips", "mips64", "mips64p32", "ppc", "ppc64",
+		"s390", "s390x", "sparc", "sparc64":
+		return false
+	}
+	return true
+}()
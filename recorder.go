@@ -0,0 +1,226 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/TheCacophonyProject/go-cptv/cptvframe"
+)
+
+// Recording file format
+//
+// A recording is a simple container of consecutive raw frames (as
+// returned by NextFrame) followed by an index which allows any frame
+// to be located without scanning the whole file. All integers are
+// little endian.
+//
+//	header:  magic "LEP3REC\x00" (8 bytes)
+//	         version             (uint16)
+//	         frame size in bytes (uint32)
+//	records: timestamp           (int64, telemetry time on, in ns)
+//	         raw frame           (frame size bytes)
+//	         ... repeated for each frame
+//	index:   timestamp           (int64)
+//	         record offset       (int64)
+//	         ... repeated for each frame
+//	trailer: frame count         (uint32)
+//	         index offset        (int64)
+//	         magic "LEP3IDX\x00" (8 bytes)
+//
+// Timestamps come from the camera's telemetry so they are monotonic
+// for a single camera power cycle and don't depend on the host clock.
+const (
+	recordingVersion     = 1
+	recordingHeaderSize  = 8 + 2 + 4
+	recordingTrailerSize = 4 + 8 + 8
+	recordingIndexSize   = 8 + 8
+	recordTimestampSize  = 8
+)
+
+var (
+	recordingMagic = [8]byte{'L', 'E', 'P', '3', 'R', 'E', 'C', 0}
+	indexMagic     = [8]byte{'L', 'E', 'P', '3', 'I', 'D', 'X', 0}
+)
+
+// ErrFrameNotFound is returned by RecordingReader when a requested
+// frame doesn't exist in the recording.
+var ErrFrameNotFound = errors.New("frame not found in recording")
+
+type recordingIndexEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// Recorder writes raw frames to a recording (see the format
+// description above). Close must be called to write out the index.
+type Recorder struct {
+	w         io.Writer
+	offset    int64
+	index     []recordingIndexEntry
+	telemetry cptvframe.Telemetry
+	buf       [recordTimestampSize]byte
+}
+
+// NewRecorder writes a recording header to w and returns a Recorder
+// ready to accept frames.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	var header [recordingHeaderSize]byte
+	copy(header[:], recordingMagic[:])
+	binary.LittleEndian.PutUint16(header[8:], recordingVersion)
+	binary.LittleEndian.PutUint32(header[10:], BytesPerFrame)
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		w:      w,
+		offset: recordingHeaderSize,
+	}, nil
+}
+
+// WriteFrame appends a raw frame to the recording. The record is
+// timestamped using the frame's telemetry.
+func (r *Recorder) WriteFrame(raw []byte) error {
+	if len(raw) != BytesPerFrame {
+		return fmt.Errorf("invalid raw frame size: %d", len(raw))
+	}
+	if err := ParseTelemetry(raw, &r.telemetry); err != nil {
+		return err
+	}
+	ts := int64(r.telemetry.TimeOn)
+	binary.LittleEndian.PutUint64(r.buf[:], uint64(ts))
+	if _, err := r.w.Write(r.buf[:]); err != nil {
+		return err
+	}
+	if _, err := r.w.Write(raw); err != nil {
+		return err
+	}
+	r.index = append(r.index, recordingIndexEntry{Timestamp: ts, Offset: r.offset})
+	r.offset += recordTimestampSize + int64(len(raw))
+	return nil
+}
+
+// Frames returns the number of frames written so far.
+func (r *Recorder) Frames() int {
+	return len(r.index)
+}
+
+// Close writes the index and trailer to the recording. It doesn't
+// close the underlying writer.
+func (r *Recorder) Close() error {
+	for _, entry := range r.index {
+		if err := binary.Write(r.w, binary.LittleEndian, entry); err != nil {
+			return err
+		}
+	}
+	var trailer [recordingTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[0:], uint32(len(r.index)))
+	binary.LittleEndian.PutUint64(trailer[4:], uint64(r.offset))
+	copy(trailer[12:], indexMagic[:])
+	_, err := r.w.Write(trailer[:])
+	return err
+}
+
+// RecordingReader provides random access to the frames in a recording
+// created by Recorder.
+type RecordingReader struct {
+	r         io.ReaderAt
+	frameSize int
+	index     []recordingIndexEntry
+}
+
+// NewRecordingReader reads the header and index of the recording in
+// r, which is size bytes long.
+func NewRecordingReader(r io.ReaderAt, size int64) (*RecordingReader, error) {
+	if size < recordingHeaderSize+recordingTrailerSize {
+		return nil, errors.New("recording too short")
+	}
+	var header [recordingHeaderSize]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], recordingMagic[:]) {
+		return nil, errors.New("not a lepton3 recording")
+	}
+	if version := binary.LittleEndian.Uint16(header[8:]); version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version: %d", version)
+	}
+	frameSize := int(binary.LittleEndian.Uint32(header[10:]))
+	if frameSize != BytesPerFrame {
+		return nil, fmt.Errorf("unsupported frame size: %d", frameSize)
+	}
+
+	var trailer [recordingTrailerSize]byte
+	if _, err := r.ReadAt(trailer[:], size-recordingTrailerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[12:], indexMagic[:]) {
+		return nil, errors.New("recording index missing (was the recorder closed?)")
+	}
+	count := int64(binary.LittleEndian.Uint32(trailer[0:]))
+	indexOffset := int64(binary.LittleEndian.Uint64(trailer[4:]))
+	// Check the count against the file size before it's used to size
+	// the index, so a corrupt trailer can't cause a huge allocation.
+	if count > (size-recordingHeaderSize-recordingTrailerSize)/recordingIndexSize ||
+		indexOffset < recordingHeaderSize ||
+		indexOffset+count*recordingIndexSize != size-recordingTrailerSize {
+		return nil, errors.New("corrupt recording index")
+	}
+
+	index := make([]recordingIndexEntry, count)
+	rawIndex := io.NewSectionReader(r, indexOffset, count*recordingIndexSize)
+	if err := binary.Read(rawIndex, binary.LittleEndian, index); err != nil {
+		return nil, err
+	}
+	return &RecordingReader{
+		r:         r,
+		frameSize: frameSize,
+		index:     index,
+	}, nil
+}
+
+// Len returns the number of frames in the recording.
+func (rr *RecordingReader) Len() int {
+	return len(rr.index)
+}
+
+// Timestamp returns the telemetry time on for frame i.
+func (rr *RecordingReader) Timestamp(i int) (time.Duration, error) {
+	if i < 0 || i >= len(rr.index) {
+		return 0, ErrFrameNotFound
+	}
+	return time.Duration(rr.index[i].Timestamp), nil
+}
+
+// ReadFrame reads frame i of the recording into the raw frame slice
+// provided (see NewRawFrame).
+func (rr *RecordingReader) ReadFrame(i int, raw []byte) error {
+	if i < 0 || i >= len(rr.index) {
+		return ErrFrameNotFound
+	}
+	if len(raw) < rr.frameSize {
+		return fmt.Errorf("output slice too small: %d < %d", len(raw), rr.frameSize)
+	}
+	_, err := rr.r.ReadAt(raw[:rr.frameSize], rr.index[i].Offset+recordTimestampSize)
+	return err
+}
+
+// FrameAt returns the index of the first frame with a timestamp at or
+// after t.
+func (rr *RecordingReader) FrameAt(t time.Duration) (int, error) {
+	i := sort.Search(len(rr.index), func(i int) bool {
+		return rr.index[i].Timestamp >= int64(t)
+	})
+	if i == len(rr.index) {
+		return -1, ErrFrameNotFound
+	}
+	return i, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testRecording returns a closed recording of n raw frames.
+func testRecording(t *testing.T, n int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	rec, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := rec.WriteFrame(NewRawFrame()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setTrailer rewrites the frame count and index offset in the trailer
+// of a recording.
+func setTrailer(data []byte, count uint32, indexOffset int64) {
+	trailer := data[len(data)-recordingTrailerSize:]
+	binary.LittleEndian.PutUint32(trailer[0:], count)
+	binary.LittleEndian.PutUint64(trailer[4:], uint64(indexOffset))
+}
+
+func TestNewRecordingReader(t *testing.T) {
+	data := testRecording(t, 3)
+	rr, err := NewRecordingReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Len() != 3 {
+		t.Errorf("got %d frames, want 3", rr.Len())
+	}
+	if err := rr.ReadFrame(2, NewRawFrame()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewRecordingReaderCorrupt(t *testing.T) {
+	const frames = 3
+	size := int64(len(testRecording(t, frames)))
+	indexEnd := size - recordingTrailerSize
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+	}{
+		{"frame size", func(data []byte) {
+			binary.LittleEndian.PutUint32(data[10:], BytesPerFrame/2)
+		}},
+		{"count too large", func(data []byte) {
+			// Consistent with the index offset, but the index
+			// would be far bigger than the file.
+			const count = 0xffffffff
+			setTrailer(data, count, indexEnd-count*recordingIndexSize)
+		}},
+		{"index before header", func(data []byte) {
+			setTrailer(data, frames, recordingHeaderSize-1)
+		}},
+		{"index doesn't end at trailer", func(data []byte) {
+			setTrailer(data, frames-1, indexEnd-frames*recordingIndexSize)
+		}},
+	}
+	for _, tt := range tests {
+		data := testRecording(t, frames)
+		tt.corrupt(data)
+		if _, err := NewRecordingReader(bytes.NewReader(data), size); err == nil {
+			t.Errorf("%s: corrupt recording accepted", tt.name)
+		}
+	}
+}
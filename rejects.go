@@ -0,0 +1,71 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import "encoding/hex"
+
+// SetRejectLog enables recording of the headers of the last n packets
+// rejected by packet validation, which can be retrieved with
+// RejectedHeaders. Seeing the actual header bits often reveals the
+// nature of SPI problems (e.g. a bit which is always flipped). A value
+// of 0 disables recording (the default).
+func (d *Lepton3) SetRejectLog(n int) {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	if n <= 0 {
+		d.rejects = nil
+		return
+	}
+	d.rejects = &rejectLog{headers: make([][vospiHeaderSize]byte, n)}
+}
+
+// RejectedHeaders returns the 4 byte headers (ID and CRC) of the most
+// recently rejected packets, oldest first, as hex strings. It returns
+// nil if recording hasn't been enabled with SetRejectLog. It is safe
+// to call from any goroutine.
+func (d *Lepton3) RejectedHeaders() []string {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	if d.rejects == nil {
+		return nil
+	}
+	return d.rejects.list()
+}
+
+// rejectLog is a fixed size ring of rejected packet headers.
+type rejectLog struct {
+	headers [][vospiHeaderSize]byte
+	next    int
+	count   int
+}
+
+func (r *rejectLog) add(packet []byte) {
+	copy(r.headers[r.next][:], packet)
+	r.next = (r.next + 1) % len(r.headers)
+	if r.count < len(r.headers) {
+		r.count++
+	}
+}
+
+func (r *rejectLog) list() []string {
+	out := make([]string, 0, r.count)
+	start := r.next - r.count
+	if start < 0 {
+		start += len(r.headers)
+	}
+	for i := 0; i < r.count; i++ {
+		h := r.headers[(start+i)%len(r.headers)]
+		out = append(out, hex.EncodeToString(h[:]))
+	}
+	return out
+}
+
+func (d *Lepton3) recordReject(packet []byte) {
+	d.statsMu.Lock()
+	if d.rejects != nil {
+		d.rejects.add(packet)
+	}
+	d.statsMu.Unlock()
+}
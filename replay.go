@@ -0,0 +1,171 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FrameSource is the frame reading interface shared by Lepton3 and
+// FileDevice, allowing applications to run unchanged against either a
+// camera or recorded data.
+type FrameSource interface {
+	NextFrame(outFrame []byte) error
+	Close()
+}
+
+var (
+	_ FrameSource = (*Lepton3)(nil)
+	_ FrameSource = (*FileDevice)(nil)
+)
+
+// FileDevice replays the frames of a recording (see Recorder) through
+// the same NextFrame interface as a camera. This is useful for testing
+// and demonstrations.
+//
+// Each recorded frame is split back into the VoSPI packets the camera
+// would send (with its telemetry as a header) and reassembled by a
+// Decoder with CRC checking enabled, so replay exercises the same
+// packet validation and frame assembly as reading from a camera.
+type FileDevice struct {
+	rr       *RecordingReader
+	closer   io.Closer
+	realTime bool
+	next     int
+
+	dec    *Decoder
+	frame  []byte // the recorded frame being replayed
+	packet [vospiPacketSize]byte
+
+	// Used to reproduce the original frame timing.
+	startTS   time.Duration
+	startTime time.Time
+}
+
+// OpenFileDevice opens the recording at path for replay. If realTime
+// is true, frames are returned with the same timing as when they were
+// recorded, otherwise they are returned as fast as possible.
+func OpenFileDevice(path string, realTime bool) (*FileDevice, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dev, err := NewFileDevice(f, info.Size(), realTime)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dev.closer = f
+	return dev, nil
+}
+
+// NewFileDevice is like OpenFileDevice but replays the recording in r,
+// which is size bytes long.
+func NewFileDevice(r io.ReaderAt, size int64, realTime bool) (*FileDevice, error) {
+	rr, err := NewRecordingReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	dec := NewDecoder()
+	dec.CheckCRC = true
+	return &FileDevice{
+		rr:       rr,
+		realTime: realTime,
+		dec:      dec,
+		frame:    NewRawFrame(),
+	}, nil
+}
+
+// NextFrame reads the next frame of the recording into outFrame. When
+// replaying in real time it first waits until the frame is due. Frames
+// without a timestamp (e.g. recorded with telemetry disabled) are
+// returned immediately. io.EOF is returned at the end of the
+// recording.
+func (f *FileDevice) NextFrame(outFrame []byte) error {
+	if f.next >= f.rr.Len() {
+		return io.EOF
+	}
+	if f.realTime {
+		ts, err := f.rr.Timestamp(f.next)
+		if err != nil {
+			return err
+		}
+		if f.next == 0 || ts < f.startTS {
+			f.startTS = ts
+			f.startTime = time.Now()
+		} else if ts > 0 {
+			due := f.startTime.Add(ts - f.startTS)
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+	if err := f.rr.ReadFrame(f.next, f.frame); err != nil {
+		return err
+	}
+	if err := f.decode(); err != nil {
+		return fmt.Errorf("frame %d: %v", f.next, err)
+	}
+	f.dec.Frame(outFrame)
+	f.next++
+	return nil
+}
+
+// decode passes the packets making up the recorded frame through the
+// Decoder.
+func (f *FileDevice) decode() error {
+	f.dec.Reset()
+	complete := false
+	for seg := 1; seg <= segmentsPerFrame; seg++ {
+		for p := 0; p < packetsPerSegment; p++ {
+			offset := ((seg-1)*packetsPerSegment + p) * vospiDataSize
+			encodePacket(f.packet[:], p, seg, f.frame[offset:offset+vospiDataSize])
+			var err error
+			complete, err = f.dec.Decode(f.packet[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !complete {
+		return errors.New("packets didn't form a complete frame")
+	}
+	return nil
+}
+
+// encodePacket builds the VoSPI packet which carries data as packet
+// packetNum of segment segmentNum into dst.
+func encodePacket(dst []byte, packetNum, segmentNum int, data []byte) {
+	binary.BigEndian.PutUint16(dst, uint16(packetNum))
+	if packetNum == segmentPacketNum {
+		dst[0] |= byte(segmentNum << 4)
+	}
+	copy(dst[vospiHeaderSize:], data)
+	binary.BigEndian.PutUint16(dst[2:], packetCRC(dst))
+}
+
+// Rewind restarts replay from the first frame.
+func (f *FileDevice) Rewind() {
+	f.next = 0
+}
+
+// Close closes the underlying file if the FileDevice was created with
+// OpenFileDevice.
+func (f *FileDevice) Close() {
+	if f.closer != nil {
+		f.closer.Close()
+		f.closer = nil
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFileDeviceReplay(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for n := 0; n < 3; n++ {
+		raw := NewRawFrame()
+		for i := range raw {
+			raw[i] = byte(i*7 + n)
+		}
+		if err := rec.WriteFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, raw)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := NewFileDevice(bytes.NewReader(buf.Bytes()), int64(buf.Len()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	raw := NewRawFrame()
+	for n, want := range frames {
+		if err := dev.NextFrame(raw); err != nil {
+			t.Fatalf("frame %d: %v", n, err)
+		}
+		if !bytes.Equal(raw, want) {
+			t.Errorf("frame %d differs from the recording", n)
+		}
+	}
+	if err := dev.NextFrame(raw); err != io.EOF {
+		t.Errorf("got %v at the end of the recording, want io.EOF", err)
+	}
+}
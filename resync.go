@@ -0,0 +1,75 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"time"
+)
+
+// ResyncPolicy selects how NextFrame recovers when it loses sync with
+// the camera's packet stream. Lighter recovery is faster but may not
+// be enough for some hardware.
+type ResyncPolicy int
+
+const (
+	// ResyncReopen closes and reopens the SPI port, then waits for
+	// the camera to resynchronise. This is the most thorough (and
+	// slowest) recovery, and the default.
+	ResyncReopen ResyncPolicy = iota
+
+	// ResyncRestartStream stops and restarts the streaming goroutine,
+	// leaving the SPI port open, and waits for the camera to
+	// resynchronise.
+	ResyncRestartStream
+
+	// ResyncDrain discards buffered packets and restarts frame
+	// assembly at the next segment, without interrupting the stream.
+	ResyncDrain
+)
+
+// How long to stop reading from the camera for it to resynchronise.
+// The Lepton datasheet requires at least 185ms.
+const resyncPause = 300 * time.Millisecond
+
+// SetResyncPolicy sets how NextFrame recovers after losing sync. If
+// escalate is true, each further resync needed while reading the same
+// frame uses the next heavier recovery (towards ResyncReopen), so a
+// light policy is tried first but can't keep failing.
+func (d *Lepton3) SetResyncPolicy(policy ResyncPolicy, escalate bool) error {
+	if policy < ResyncReopen || policy > ResyncDrain {
+		return fmt.Errorf("invalid resync policy: %d", policy)
+	}
+	d.resyncPolicy = policy
+	d.resyncEscalate = escalate
+	return nil
+}
+
+// resyncStrategy returns the recovery to use for the next resync
+// given the number already performed while reading this frame.
+func (d *Lepton3) resyncStrategy(resyncs int) ResyncPolicy {
+	policy := d.resyncPolicy
+	if d.resyncEscalate {
+		policy -= ResyncPolicy(resyncs)
+		if policy < ResyncReopen {
+			policy = ResyncReopen
+		}
+	}
+	return policy
+}
+
+// restartStream implements ResyncRestartStream.
+func (d *Lepton3) restartStream() error {
+	d.stopStream()
+	d.frameBuilder.reset()
+	time.Sleep(resyncPause)
+	return d.startStream()
+}
+
+// drainPackets implements ResyncDrain.
+func (d *Lepton3) drainPackets() {
+	d.Flush()
+	d.awaitSegment = true
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Rotation is a clockwise image rotation in degrees.
+type Rotation int
+
+// Valid values for Rotation.
+const (
+	Rotate0   Rotation = 0
+	Rotate90  Rotation = 90
+	Rotate180 Rotation = 180
+	Rotate270 Rotation = 270
+)
+
+func (r Rotation) valid() bool {
+	return r == Rotate0 || r == Rotate90 || r == Rotate180 || r == Rotate270
+}
+
+// rotatedSize returns the size of an image of size s after rotation.
+func (r Rotation) rotatedSize(s image.Point) image.Point {
+	if r == Rotate90 || r == Rotate270 {
+		return image.Pt(s.Y, s.X)
+	}
+	return s
+}
+
+// Rotate returns a copy of src rotated clockwise by rot. The output is
+// sized to fit the rotated image exactly, so 90 and 270 degree
+// rotations swap the width and height.
+func Rotate(src *image.Gray16, rot Rotation) (*image.Gray16, error) {
+	if !rot.valid() {
+		return nil, fmt.Errorf("invalid rotation: %d", rot)
+	}
+	size := rot.rotatedSize(src.Bounds().Size())
+	dst := image.NewGray16(image.Rect(0, 0, size.X, size.Y))
+	rotateInto(src, dst, image.Point{}, rot)
+	return dst, nil
+}
+
+// RotateLetterbox rotates src clockwise by rot and draws it centred on
+// a canvas of the given size, filling the remaining area with
+// fill. This gives consistent output dimensions regardless of the
+// rotation, which some display pipelines require. The canvas must be
+// large enough to hold the rotated image.
+func RotateLetterbox(src *image.Gray16, rot Rotation, canvas image.Point, fill color.Gray16) (*image.Gray16, error) {
+	if !rot.valid() {
+		return nil, fmt.Errorf("invalid rotation: %d", rot)
+	}
+	size := rot.rotatedSize(src.Bounds().Size())
+	if size.X > canvas.X || size.Y > canvas.Y {
+		return nil, fmt.Errorf("rotated image %v doesn't fit canvas %v", size, canvas)
+	}
+	dst := image.NewGray16(image.Rect(0, 0, canvas.X, canvas.Y))
+	if fill.Y != 0 {
+		for i := 0; i < len(dst.Pix); i += 2 {
+			dst.Pix[i] = uint8(fill.Y >> 8)
+			dst.Pix[i+1] = uint8(fill.Y)
+		}
+	}
+	rotateInto(src, dst, canvas.Sub(size).Div(2), rot)
+	return dst, nil
+}
+
+// rotateInto draws src rotated by rot into dst with its top left
+// corner at offset.
+func rotateInto(src, dst *image.Gray16, offset image.Point, rot Rotation) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch rot {
+			case Rotate90:
+				dx, dy = h-1-y, x
+			case Rotate180:
+				dx, dy = w-1-x, h-1-y
+			case Rotate270:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			i := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			j := dst.PixOffset(offset.X+dx, offset.Y+dy)
+			dst.Pix[j] = src.Pix[i]
+			dst.Pix[j+1] = src.Pix[i+1]
+		}
+	}
+}
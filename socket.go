@@ -0,0 +1,197 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Frames sent by FrameServer are prefixed with their length as a big
+// endian uint32.
+const socketLengthSize = 4
+
+// Number of frames queued for each FrameServer client. Frames are
+// dropped for clients which fall further behind than this.
+const socketQueueSize = 2
+
+// FrameServer publishes raw frames to clients connected over a socket,
+// typically a Unix domain socket. This allows capture and processing
+// to run in separate processes on the same host, with only the capture
+// process accessing the camera hardware. Clients receive frames using
+// SocketDevice.
+//
+// Each frame is sent as its length (a big endian uint32) followed by
+// the raw frame. Frames are dropped for clients which can't keep up,
+// so a slow client doesn't hold up capture or other clients.
+type FrameServer struct {
+	l       net.Listener
+	mu      sync.Mutex
+	clients map[*socketClient]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// ListenFrameServer returns a FrameServer listening on the Unix domain
+// socket at path.
+func ListenFrameServer(path string) (*FrameServer, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewFrameServer(l), nil
+}
+
+// NewFrameServer returns a FrameServer which accepts clients from l.
+func NewFrameServer(l net.Listener) *FrameServer {
+	s := &FrameServer{
+		l:       l,
+		clients: make(map[*socketClient]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+type socketClient struct {
+	conn   net.Conn
+	frames chan []byte
+	free   chan []byte
+}
+
+func (s *FrameServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &socketClient{
+			conn:   conn,
+			frames: make(chan []byte, socketQueueSize),
+			free:   make(chan []byte, socketQueueSize+1),
+		}
+		for i := 0; i < cap(c.free); i++ {
+			c.free <- make([]byte, socketLengthSize+BytesPerFrame)
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// serve writes queued frames to a client until the connection fails
+// or the server is closed.
+func (s *FrameServer) serve(c *socketClient) {
+	defer s.wg.Done()
+	defer c.conn.Close()
+	for buf := range c.frames {
+		_, err := c.conn.Write(buf)
+		c.free <- buf
+		if err != nil {
+			s.remove(c)
+			return
+		}
+	}
+}
+
+func (s *FrameServer) remove(c *socketClient) {
+	s.mu.Lock()
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.frames)
+	}
+	s.mu.Unlock()
+}
+
+// Publish queues a raw frame to be sent to every connected client. It
+// doesn't block, and raw may be reused as soon as it returns.
+func (s *FrameServer) Publish(raw []byte) error {
+	if len(raw) != BytesPerFrame {
+		return fmt.Errorf("invalid raw frame size: %d", len(raw))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case buf := <-c.free:
+			binary.BigEndian.PutUint32(buf, uint32(len(raw)))
+			copy(buf[socketLengthSize:], raw)
+			c.frames <- buf
+		default:
+			// The client is behind so drop the frame.
+		}
+	}
+	return nil
+}
+
+// Close stops accepting clients and disconnects those connected.
+func (s *FrameServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		delete(s.clients, c)
+		close(c.frames)
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
+
+// SocketDevice receives frames published by a FrameServer through the
+// same NextFrame interface as a camera.
+type SocketDevice struct {
+	conn   net.Conn
+	header [socketLengthSize]byte
+}
+
+var _ FrameSource = (*SocketDevice)(nil)
+
+// DialFrameServer connects to a FrameServer. network is usually
+// "unix", with address the path of the server's socket.
+func DialFrameServer(network, address string) (*SocketDevice, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketDevice{conn: conn}, nil
+}
+
+// NextFrame reads the next frame from the server into outFrame. It
+// blocks until a frame arrives. io.EOF is returned if the server
+// closes the connection.
+func (s *SocketDevice) NextFrame(outFrame []byte) error {
+	if _, err := io.ReadFull(s.conn, s.header[:]); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(s.header[:]))
+	if size != BytesPerFrame {
+		return fmt.Errorf("invalid frame size from server: %d", size)
+	}
+	if len(outFrame) < size {
+		return fmt.Errorf("output slice too small: %d < %d", len(outFrame), size)
+	}
+	_, err := io.ReadFull(s.conn, outFrame[:size])
+	return err
+}
+
+// Close disconnects from the server.
+func (s *SocketDevice) Close() {
+	s.conn.Close()
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"fmt"
+
+	"periph.io/x/periph/conn/spi"
+)
+
+// SPIReadMode selects how SPI transfers read from the camera. The
+// camera ignores the data written to it, so reads are normally made
+// with nothing to write, but some SPI adapters and drivers misbehave
+// (failing or returning garbage) when called that way.
+type SPIReadMode int
+
+const (
+	// SPIReadNilTx calls Tx with a nil write buffer. This is the
+	// default.
+	SPIReadNilTx SPIReadMode = iota
+
+	// SPIReadZeroTx calls Tx with a zero filled write buffer the
+	// same size as the read buffer, for drivers which only support
+	// full duplex transfers.
+	SPIReadZeroTx
+
+	// SPIReadPacket reads using TxPackets with a single read only
+	// packet, for drivers which support half duplex reads.
+	SPIReadPacket
+)
+
+// SetSPIReadMode sets how SPI transfers read from the camera, to work
+// around non-standard SPI backends. It takes effect the next time
+// streaming starts.
+func (d *Lepton3) SetSPIReadMode(mode SPIReadMode) error {
+	if mode < SPIReadNilTx || mode > SPIReadPacket {
+		return fmt.Errorf("invalid SPI read mode: %d", mode)
+	}
+	d.spiReadMode = mode
+	return nil
+}
+
+// spiReader returns the function used by the streaming goroutine to
+// read from the camera.
+func (d *Lepton3) spiReader() func(rx []byte) error {
+	conn := d.spiConn
+	switch d.spiReadMode {
+	case SPIReadZeroTx:
+		var tx []byte
+		return func(rx []byte) error {
+			if len(tx) < len(rx) {
+				tx = make([]byte, len(rx))
+			}
+			return conn.Tx(tx[:len(rx)], rx)
+		}
+	case SPIReadPacket:
+		packets := make([]spi.Packet, 1)
+		return func(rx []byte) error {
+			packets[0] = spi.Packet{R: rx}
+			return conn.TxPackets(packets)
+		}
+	}
+	return func(rx []byte) error {
+		return conn.Tx(nil, rx)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import "time"
+
+// Stats holds counters accumulated while reading frames from the
+// camera. The embedded Counters cover the lifetime of the Lepton3 and
+// are never reset, while Session covers only the time since Open was
+// last called. Resyncs and reboots reopen the connection internally
+// and don't start a new session.
+type Stats struct {
+	Counters
+
+	// Session holds the counters for the current session.
+	Session Counters
+
+	// Sessions is the number of times Open has been called.
+	Sessions uint64
+
+	// SessionStart is when the current session was opened.
+	SessionStart time.Time
+
+	// SegmentJitter holds segment arrival jitter statistics, when
+	// enabled using SetSegmentJitter.
+	SegmentJitter JitterStats
+
+	// TxLatency holds the SPI transfer latency histogram, when
+	// enabled using SetTxLatency.
+	TxLatency TxLatency
+}
+
+// Counters are the individual counters making up Stats.
+type Counters struct {
+	// Frames is the number of frames returned by NextFrame.
+	Frames uint64
+
+	// BytesTransferred is the number of bytes read from the camera
+	// over SPI, including discard packets.
+	BytesTransferred uint64
+
+	// Packets is the number of valid packets (i.e. not discard
+	// packets and passing validation) processed by NextFrame.
+	Packets uint64
+
+	// Resyncs is the number of times the connection to the camera
+	// was resynchronised.
+	Resyncs uint64
+
+	// BadPackets is the number of packets rejected due to failed
+	// validation or arriving out of sequence.
+	BadPackets uint64
+
+	// CRCErrors is the number of packets rejected due to a CRC
+	// mismatch (only counted when CRC checking is enabled).
+	CRCErrors uint64
+
+	// SegmentCRCErrors breaks CRCErrors down by the segment (from 1
+	// up to the number of segments per frame) being assembled when
+	// the error occurred. Index 0 counts errors where the segment
+	// wasn't known. Errors clustering in
+	// particular segments can indicate timing problems at segment
+	// boundaries.
+	SegmentCRCErrors [segmentsPerFrame + 1]uint64
+
+	// QualityRejects is the number of assembled frames rejected by
+	// the quality gate (see SetQualityGate).
+	QualityRejects uint64
+
+	// DroppedPackets is the number of packets discarded because the
+	// packet buffer was full (see BufferDropOldest).
+	DroppedPackets uint64
+
+	// StuckImages is the number of times the camera's image was
+	// detected as frozen (see SetStuckDetection).
+	StuckImages uint64
+}
+
+// Stats returns a snapshot of the counters accumulated so far. It is
+// safe to call from any goroutine.
+func (d *Lepton3) Stats() Stats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	return d.stats
+}
+
+// StatsInto is like Stats but fills in a caller provided struct,
+// avoiding the copy out of a return value in high frequency monitoring
+// loops. The snapshot is taken under a lock so it is internally
+// consistent.
+func (d *Lepton3) StatsInto(s *Stats) {
+	d.statsMu.Lock()
+	*s = d.stats
+	d.statsMu.Unlock()
+}
+
+// startSession resets the session counters.
+func (d *Lepton3) startSession() {
+	d.statsMu.Lock()
+	d.stats.Session = Counters{}
+	d.stats.Sessions++
+	d.stats.SessionStart = time.Now()
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countFrame() {
+	d.statsMu.Lock()
+	d.stats.Frames++
+	d.stats.Session.Frames++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countTransfer(n int) {
+	d.statsMu.Lock()
+	d.stats.BytesTransferred += uint64(n)
+	d.stats.Session.BytesTransferred += uint64(n)
+	d.statsMu.Unlock()
+}
+
+// flushPackets adds the valid packets counted by NextFrame to the
+// stats. They're counted separately to avoid taking the lock for every
+// packet.
+func (d *Lepton3) flushPackets() {
+	if d.validPackets == 0 {
+		return
+	}
+	d.statsMu.Lock()
+	d.stats.Packets += d.validPackets
+	d.stats.Session.Packets += d.validPackets
+	d.statsMu.Unlock()
+	d.validPackets = 0
+}
+
+func (d *Lepton3) countResync() {
+	d.statsMu.Lock()
+	d.stats.Resyncs++
+	d.stats.Session.Resyncs++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countBadPacket() {
+	d.statsMu.Lock()
+	d.stats.BadPackets++
+	d.stats.Session.BadPackets++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countQualityReject() {
+	d.statsMu.Lock()
+	d.stats.QualityRejects++
+	d.stats.Session.QualityRejects++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countDroppedPacket() {
+	d.statsMu.Lock()
+	d.stats.DroppedPackets++
+	d.stats.Session.DroppedPackets++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countStuckImage() {
+	d.statsMu.Lock()
+	d.stats.StuckImages++
+	d.stats.Session.StuckImages++
+	d.statsMu.Unlock()
+}
+
+func (d *Lepton3) countCRCError(segment int) {
+	if segment < 0 || segment > d.frameBuilder.segments {
+		segment = 0
+	}
+	d.statsMu.Lock()
+	d.stats.CRCErrors++
+	d.stats.SegmentCRCErrors[segment]++
+	d.stats.Session.CRCErrors++
+	d.stats.Session.SegmentCRCErrors[segment]++
+	d.statsMu.Unlock()
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrStuckImage is returned by NextFrame when the camera's image has
+// frozen (see SetStuckDetection). The frame is still returned.
+var ErrStuckImage = errors.New("camera image is stuck (identical frames)")
+
+// StuckAction selects what NextFrame does when it detects that the
+// camera's image has frozen.
+type StuckAction int
+
+const (
+	// StuckReport makes NextFrame return ErrStuckImage, leaving the
+	// recovery to the caller.
+	StuckReport StuckAction = iota
+
+	// StuckFFC runs an FFC, which is often enough to get the camera
+	// going again.
+	StuckFFC
+
+	// StuckResync resyncs with the camera (see SetResyncPolicy).
+	StuckResync
+)
+
+// SetStuckDetection enables detection of a frozen image, where the
+// given number of consecutive frames have identical pixels. Some
+// camera lock-ups produce output which looks valid, with changing
+// telemetry, but never changes. Real scenes always have some sensor
+// noise, so even a static scene doesn't produce identical frames.
+// action selects the response. Detections are counted in Stats. A
+// frames value of 0 disables detection (the default).
+func (d *Lepton3) SetStuckDetection(frames int, action StuckAction) error {
+	if frames == 0 {
+		d.stuck = nil
+		return nil
+	}
+	if frames < 2 {
+		return errors.New("stuck detection needs at least 2 frames")
+	}
+	if action < StuckReport || action > StuckResync {
+		return fmt.Errorf("invalid stuck action: %d", action)
+	}
+	d.stuck = &stuckDetector{limit: frames, action: action}
+	return nil
+}
+
+type stuckDetector struct {
+	limit     int
+	action    StuckAction
+	last      []byte
+	identical int // consecutive frames matching last
+}
+
+// add records the pixels of a frame (a raw frame without its
+// telemetry, which changes even when the image is frozen), returning
+// true if the image is stuck.
+func (s *stuckDetector) add(pix []byte) bool {
+	if s.identical > 0 && bytes.Equal(pix, s.last) {
+		s.identical++
+	} else {
+		s.last = append(s.last[:0], pix...)
+		s.identical = 1
+	}
+	if s.identical < s.limit {
+		return false
+	}
+	// Only detect again after another limit frames.
+	s.identical = 0
+	return true
+}
+
+// checkStuck checks the frame just assembled by NextFrame for a stuck
+// image and responds as configured.
+func (d *Lepton3) checkStuck() error {
+	if d.stuck == nil || !d.stuck.add(d.frameBuilder.pixelData()) {
+		return nil
+	}
+	d.countStuckImage()
+	d.logf(LogWarn, "image stuck for %d frames", d.stuck.limit)
+	switch d.stuck.action {
+	case StuckFFC:
+		return d.RunFFCContext(context.Background())
+	case StuckResync:
+		return d.resync(ErrStuckImage)
+	}
+	return ErrStuckImage
+}
@@ -8,8 +8,10 @@
 package lepton3
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
 	"time"
 
 	"github.com/TheCacophonyProject/go-cptv/cptvframe"
@@ -27,7 +29,7 @@ const (
 // data into a Telemetry struct.
 func ParseTelemetry(raw []byte, t *cptvframe.Telemetry) error {
 	var tw telemetryWords
-	if err := binary.Read(bytes.NewBuffer(raw), Big16, &tw); err != nil {
+	if err := tw.decode(raw); err != nil {
 		return err
 	}
 
@@ -41,6 +43,8 @@ func ParseTelemetry(raw []byte, t *cptvframe.Telemetry) error {
 	return nil
 }
 
+// LeptonSoftwareRevision holds the camera's software (GPP) and DSP
+// firmware revisions.
 type LeptonSoftwareRevision struct {
 	Gpp_major uint8
 	Gpp_minor uint8
@@ -51,6 +55,13 @@ type LeptonSoftwareRevision struct {
 	Reserved  [2]uint8
 }
 
+// String returns the revisions in the form "gpp 3.3.26, dsp 3.3.26".
+func (r LeptonSoftwareRevision) String() string {
+	return fmt.Sprintf("gpp %d.%d.%d, dsp %d.%d.%d",
+		r.Gpp_major, r.Gpp_minor, r.Gpp_build,
+		r.Dsp_major, r.Dsp_minor, r.Dsp_build)
+}
+
 type telemetryWords struct {
 	TelemetryRevision  uint16                 // 0  *
 	TimeOn             durationMS             // 1  *
@@ -70,6 +81,37 @@ type telemetryWords struct {
 	HousingTempLastFFC centiK
 }
 
+// Size of telemetryWords in bytes.
+const telemetryWordsSize = 33 * 2
+
+// decode fills in the fields of tw used by ParseTelemetry from raw.
+// This is equivalent to using binary.Read with Big16 but doesn't
+// allocate, which matters as it is called for every frame.
+func (tw *telemetryWords) decode(raw []byte) error {
+	if len(raw) < telemetryWordsSize {
+		return io.ErrUnexpectedEOF
+	}
+	word32 := func(i int) uint32 {
+		return Big16.Uint32(raw[i*2:])
+	}
+	word := func(i int) uint16 {
+		return Big16.Uint16(raw[i*2:])
+	}
+	tw.TelemetryRevision = word(0)
+	tw.TimeOn = durationMS(word32(1))
+	tw.StatusBits = word32(3)
+	tw.FrameCounter = word32(20)
+	tw.FrameMean = word(22)
+	tw.FPATempCounts = word(23)
+	tw.FPATemp = centiK(word(24))
+	tw.HousingTempRaw = word(25)
+	tw.HousingTemp = centiK(word(26))
+	tw.FPATempLastFFC = centiK(word(29))
+	tw.TimeCounterLastFFC = durationMS(word32(30))
+	tw.HousingTempLastFFC = centiK(word(32))
+	return nil
+}
+
 // durationMS is duration in millisecond.
 //
 // It is an implementation detail of the protocol.
@@ -90,6 +132,24 @@ func (c centiK) ToC() float64 {
 	return float64(int(c)-27315) / 100
 }
 
+// rawFFCState extracts the FFC state from the status bits in a raw
+// frame's telemetry without parsing the rest of the telemetry.
+func rawFFCState(raw []byte) string {
+	return statusToFFCState(Big16.Uint32(raw[telemetryStatusOffset:]))
+}
+
+// rawFrameCount extracts the frame counter from a raw frame's
+// telemetry.
+func rawFrameCount(raw []byte) uint32 {
+	return Big16.Uint32(raw[telemetryFrameCounterOffset:])
+}
+
+// Byte offsets of fields within the telemetry.
+const (
+	telemetryStatusOffset       = 3 * 2
+	telemetryFrameCounterOffset = 20 * 2
+)
+
 const statusFFCStateMask uint32 = 3 << 4
 const statusFFCStateShift uint32 = 4
 
@@ -106,3 +166,98 @@ func statusToFFCState(status uint32) string {
 		return FFCComplete
 	}
 }
+
+// TelemetryStats holds the scene statistics which the camera includes
+// in its telemetry. These are calculated by the camera itself so can
+// be used to cross-check statistics calculated on the host.
+//
+// The layout supported is that of telemetry rows A and C as described
+// in the Lepton engineering datasheet (rev 200 onwards). The spotmeter
+// values are only meaningful on radiometric models with radiometry
+// enabled.
+type TelemetryStats struct {
+	// FrameMean is the mean of the frame's pixel values.
+	FrameMean uint16
+
+	// The minimum, maximum and mean pixel values, and the number of
+	// pixels, in the spotmeter region of interest.
+	SpotmeterMean       uint16
+	SpotmeterMax        uint16
+	SpotmeterMin        uint16
+	SpotmeterPopulation uint16
+	SpotmeterROI        image.Rectangle
+}
+
+// ParseTelemetryStats extracts the scene statistics from a raw frame's
+// telemetry. Telemetry must have been enabled when the frame was
+// captured.
+func ParseTelemetryStats(raw []byte) (*TelemetryStats, error) {
+	if len(raw) < telemetryBytes {
+		return nil, fmt.Errorf("raw frame too short: %d", len(raw))
+	}
+	word := func(i int) uint16 {
+		return Big16.Uint16(raw[i*2:])
+	}
+	if word(telemetryRevisionWord) == 0 {
+		return nil, errors.New("frame has no telemetry")
+	}
+	return &TelemetryStats{
+		FrameMean:           word(telemetryFrameMeanWord),
+		SpotmeterMean:       word(telemetrySpotmeterWord),
+		SpotmeterMax:        word(telemetrySpotmeterWord + 1),
+		SpotmeterMin:        word(telemetrySpotmeterWord + 2),
+		SpotmeterPopulation: word(telemetrySpotmeterWord + 3),
+		// The ROI is start row, start column, end row, end column
+		// with the ends inclusive.
+		SpotmeterROI: image.Rect(
+			int(word(telemetrySpotmeterWord+5)),
+			int(word(telemetrySpotmeterWord+4)),
+			int(word(telemetrySpotmeterWord+7))+1,
+			int(word(telemetrySpotmeterWord+6))+1,
+		),
+	}, nil
+}
+
+// Word offsets of fields within the telemetry. Row C starts at word
+// 160, with the spotmeter values following the TLinear enable and
+// resolution at words 48 and 49 of the row.
+const (
+	telemetryRevisionWord  = 0
+	telemetryFrameMeanWord = 22
+	telemetrySpotmeterWord = 160 + 50
+)
+
+// StatsComparison holds the scene statistics reported by the camera
+// alongside the equivalent statistics calculated on the host.
+type StatsComparison struct {
+	Device TelemetryStats
+
+	// HostFrameMean is the mean of all the frame's pixel values.
+	HostFrameMean float64
+
+	// HostSpotmeter holds the statistics of the pixels in the
+	// spotmeter region of interest reported by the camera.
+	HostSpotmeter PixelStats
+}
+
+// CompareTelemetryStats calculates the host side equivalents of the
+// scene statistics in a raw frame's telemetry. Discrepancies can
+// indicate problems with host side pixel processing, or that the
+// camera's statistics were calculated on differently processed data
+// (e.g. after AGC).
+func CompareTelemetryStats(raw []byte) (*StatsComparison, error) {
+	device, err := ParseTelemetryStats(raw)
+	if err != nil {
+		return nil, err
+	}
+	img := NewRawImage(raw).Freeze()
+	c := &StatsComparison{
+		Device:        *device,
+		HostFrameMean: ComputePixelStats(img, nil).Mean,
+	}
+	roi := device.SpotmeterROI.Intersect(img.Bounds())
+	if !roi.Empty() {
+		c.HostSpotmeter = ComputePixelStats(img.SubImage(roi).(*image.Gray16), nil)
+	}
+	return c, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseTelemetryStats(t *testing.T) {
+	raw := NewRawFrame()
+	word := func(i int, val uint16) {
+		Big16.PutUint16(raw[i*2:], val)
+	}
+	word(0, 14)   // telemetry revision
+	word(22, 800) // frame mean
+	// Row C: TLinear enable and resolution, then the spotmeter.
+	word(160+48, 1)
+	word(160+49, 1)
+	word(160+50, 3000)
+	word(160+51, 3100)
+	word(160+52, 2900)
+	word(160+53, 4)
+	word(160+54, 59) // start row
+	word(160+55, 79) // start column
+	word(160+56, 60) // end row
+	word(160+57, 80) // end column
+
+	stats, err := ParseTelemetryStats(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TelemetryStats{
+		FrameMean:           800,
+		SpotmeterMean:       3000,
+		SpotmeterMax:        3100,
+		SpotmeterMin:        2900,
+		SpotmeterPopulation: 4,
+		SpotmeterROI:        image.Rect(79, 59, 81, 61),
+	}
+	if *stats != want {
+		t.Errorf("got %+v, want %+v", *stats, want)
+	}
+}
+
+func TestParseTelemetryStatsNoTelemetry(t *testing.T) {
+	if _, err := ParseTelemetryStats(NewRawFrame()); err == nil {
+		t.Error("expected an error for a frame without telemetry")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// TxLatencyBounds are the upper bounds of the buckets of the
+// TxLatency histogram. They must not be modified.
+var TxLatencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// TxLatency is a coarse histogram of the wall time taken by each SPI
+// transfer (see SetTxLatency). Transfers normally take roughly the
+// time needed to clock the data at the SPI speed, so a long tail of
+// slow transfers shows that the host isn't servicing the bus fast
+// enough (e.g. due to CPU contention), which leads to frame loss.
+type TxLatency struct {
+	Count uint64 // number of transfers measured
+	Max   time.Duration
+
+	// Histogram counts transfers by latency. Histogram[i] counts
+	// transfers taking up to TxLatencyBounds[i] (and longer than
+	// the previous bound). The last entry counts transfers slower
+	// than all the bounds.
+	Histogram [len(TxLatencyBounds) + 1]uint64
+}
+
+// Percentile returns an upper bound on the latency of the fastest p
+// percent (0-100) of transfers: the bound of the histogram bucket the
+// percentile falls in, or Max for the last bucket. 0 is returned if
+// no transfers have been measured.
+func (l TxLatency) Percentile(p float64) time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(l.Count)))
+	if target == 0 {
+		target = 1
+	}
+	var seen uint64
+	for i, n := range l.Histogram {
+		seen += n
+		if seen >= target && i < len(TxLatencyBounds) {
+			return TxLatencyBounds[i]
+		}
+	}
+	return l.Max
+}
+
+// SetTxLatency enables or disables measurement of the latency of each
+// SPI transfer, reported in Stats.TxLatency. Enabling resets the
+// histogram. It is disabled by default, in which case it adds no
+// overhead.
+func (d *Lepton3) SetTxLatency(enable bool) {
+	d.statsMu.Lock()
+	d.stats.TxLatency = TxLatency{}
+	d.statsMu.Unlock()
+	var flag int32
+	if enable {
+		flag = 1
+	}
+	atomic.StoreInt32(&d.measureTx, flag)
+}
+
+func (d *Lepton3) countTxLatency(latency time.Duration) {
+	bucket := len(TxLatencyBounds)
+	for i, bound := range TxLatencyBounds {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	d.statsMu.Lock()
+	l := &d.stats.TxLatency
+	l.Count++
+	l.Histogram[bucket]++
+	if latency > l.Max {
+		l.Max = latency
+	}
+	d.statsMu.Unlock()
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package lepton3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Only the first few errors found by a verification are kept.
+const maxVerifyErrors = 100
+
+// VerifyReport summarises the integrity of a recording or packet
+// stream, as checked by VerifyRecording or VerifyPacketStream.
+type VerifyReport struct {
+	// Frames is the number of complete frames found.
+	Frames int
+
+	// ErrorCount is the number of problems found. Errors holds the
+	// first of them.
+	ErrorCount int
+	Errors     []error
+
+	// Truncated is true if the data ends part way through a frame.
+	Truncated bool
+
+	// Indexed is true if a recording has a valid index (i.e. the
+	// Recorder was closed) which matches the frames found. It is
+	// always false for packet streams.
+	Indexed bool
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return r.ErrorCount == 0 && !r.Truncated
+}
+
+func (r *VerifyReport) addError(err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxVerifyErrors {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// VerifyRecording checks a recording created by Recorder, which is
+// size bytes long. The frame records are scanned in order rather than
+// relying on the index, so recordings which weren't closed can still
+// be checked. Frames with timestamps which go backwards or with pixel
+// values outside the camera's 14-bit range are reported as errors.
+//
+// An error is only returned if r can't be read or doesn't hold a
+// recording at all. Problems with the recording's contents are
+// reported in the VerifyReport.
+func VerifyRecording(r io.ReaderAt, size int64) (*VerifyReport, error) {
+	var header [recordingHeaderSize]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], recordingMagic[:]) {
+		return nil, errors.New("not a lepton3 recording")
+	}
+	if version := binary.LittleEndian.Uint16(header[8:]); version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version: %d", version)
+	}
+	frameSize := int64(binary.LittleEndian.Uint32(header[10:]))
+	if frameSize != BytesPerFrame {
+		return nil, fmt.Errorf("unsupported frame size: %d", frameSize)
+	}
+	report := new(VerifyReport)
+
+	// The records end at the index if there is a valid one, otherwise
+	// at the end of the file.
+	end := size
+	indexCount := int64(-1)
+	var trailer [recordingTrailerSize]byte
+	if size >= recordingHeaderSize+recordingTrailerSize {
+		if _, err := r.ReadAt(trailer[:], size-recordingTrailerSize); err != nil {
+			return nil, err
+		}
+		count := int64(binary.LittleEndian.Uint32(trailer[0:]))
+		indexOffset := int64(binary.LittleEndian.Uint64(trailer[4:]))
+		if bytes.Equal(trailer[12:], indexMagic[:]) &&
+			indexOffset >= recordingHeaderSize &&
+			indexOffset+count*recordingIndexSize == size-recordingTrailerSize {
+			end = indexOffset
+			indexCount = count
+		}
+	}
+
+	recordSize := recordTimestampSize + frameSize
+	record := make([]byte, recordSize)
+	lastTS := int64(-1)
+	offset := int64(recordingHeaderSize)
+	for ; offset+recordSize <= end; offset += recordSize {
+		if _, err := r.ReadAt(record, offset); err != nil {
+			return nil, err
+		}
+		ts := int64(binary.LittleEndian.Uint64(record))
+		if ts < lastTS {
+			report.addError(fmt.Errorf("frame %d: timestamp went backwards", report.Frames))
+		}
+		lastTS = ts
+		if over := countOver14Bit(record[recordTimestampSize:]); over > 0 {
+			report.addError(fmt.Errorf("frame %d: %d pixels outside the 14-bit range", report.Frames, over))
+		}
+		report.Frames++
+	}
+	if offset != end {
+		report.Truncated = true
+	}
+
+	if indexCount < 0 {
+		report.addError(errors.New("recording index missing (was the recorder closed?)"))
+	} else if indexCount != int64(report.Frames) {
+		report.addError(fmt.Errorf("index has %d frames but %d were found", indexCount, report.Frames))
+	} else {
+		report.Indexed = true
+	}
+	return report, nil
+}
+
+// VerifyPacketStream checks a stream of raw VoSPI packets, as would be
+// passed to Decoder, using the default telemetry layout. Packets which
+// fail validation (including CRC checks) or arrive out of sequence are
+// reported as errors. An error is only returned if r can't be read.
+func VerifyPacketStream(r io.Reader) (*VerifyReport, error) {
+	report := new(VerifyReport)
+	dec := NewDecoder()
+	dec.CheckCRC = true
+	packet := make([]byte, vospiPacketSize)
+	for n := 0; ; n++ {
+		_, err := io.ReadFull(r, packet)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			report.Truncated = true
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		complete, err := dec.Decode(packet)
+		if err != nil {
+			report.addError(fmt.Errorf("packet %d: %v", n, err))
+		} else if complete {
+			report.Frames++
+		}
+	}
+	if inProgress, _ := dec.InProgress(); inProgress {
+		report.Truncated = true
+	}
+	return report, nil
+}
+
+// countOver14Bit returns the number of pixels in a raw frame with
+// values above MaxRawValue.
+func countOver14Bit(raw []byte) int {
+	pix := raw[telemetryBytes:]
+	over := 0
+	for i := 0; i < FrameCols*FrameRows*2; i += 2 {
+		if Big16.Uint16(pix[i:]) > MaxRawValue {
+			over++
+		}
+	}
+	return over
+}